@@ -2,14 +2,19 @@ package mobile
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
+	"errors"
 	"fmt"
+	"io"
 	"net"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/Evan2698/chimney/utils"
+	"github.com/Evan2698/netstackm/common"
 	"github.com/Evan2698/netstackm/dns"
 	"github.com/Evan2698/netstackm/netcore"
 	"golang.org/x/net/proxy"
@@ -17,10 +22,23 @@ import (
 
 var gstack *netcore.Stack
 
+const (
+	stopTimeout = 300 * time.Millisecond
+	// keepAlivePeriod detects apps which went away without closing their
+	// connections
+	keepAlivePeriod = time.Minute
+)
+
 // StartService ...
 func StartService(fd int, proxy string, dns string) bool {
+	return StartServiceWithMTU(fd, common.CONFIGMTU, proxy, dns)
+}
+
+// StartServiceWithMTU starts the service on a tun device configured with
+// mtu, TCP segments are sized to fit it.
+func StartServiceWithMTU(fd int, mtu int, proxy string, dns string) bool {
 	var err error
-	gstack, err = netcore.New(fd)
+	gstack, err = netcore.NewWithEndpoint(netcore.NewFDEndpoint(fd, mtu))
 	if err != nil {
 		utils.LOG.Print("create tun stack failed", err)
 		return false
@@ -59,6 +77,9 @@ func handTCPConnection(c *netcore.Connection, url string) {
 		con.Close()
 	}(c)
 
+	c.SetKeepAlivePeriod(keepAlivePeriod)
+	c.SetKeepAlive(true)
+
 	utils.LOG.Println("proxy", url)
 	dialer, err := proxy.SOCKS5("tcp", url, nil, proxy.Direct)
 	if err != nil {
@@ -87,14 +108,21 @@ func handTCPConnection(c *netcore.Connection, url string) {
 		var sz = make([]byte, 1460)
 		for {
 			n, err := con.Read(sz)
+			if err == io.EOF {
+				// the server is done, pass the half-close on
+				c.CloseWrite()
+				break
+			}
 			if err != nil {
 				utils.LOG.Print("read proxy failed", err)
+				c.Close()
 				break
 			}
 			utils.LOG.Println("LENGTH OF RECV: ", n)
 			_, err = c.Write(sz[:n])
 			if err != nil {
 				utils.LOG.Print("write tun failed", err)
+				closeUpstream(con, err)
 				break
 			}
 		}
@@ -103,23 +131,50 @@ func handTCPConnection(c *netcore.Connection, url string) {
 	var buffer = make([]byte, 1460)
 	for {
 		n, err := c.Read(buffer)
+		if err == io.EOF {
+			// the client is done, the response may still be coming
+			closeWrite(con)
+			break
+		}
 		if err != nil {
 			utils.LOG.Print("exit", err)
+			closeUpstream(con, err)
 			break
 		}
 		utils.LOG.Println("Length of TCP DATA: ", n)
 		_, err = con.Write(buffer[:n])
 		if err != nil {
 			utils.LOG.Print("proxy write error", err)
+			c.Close()
 			break
 		}
 	}
 
 	wg.Wait()
-	time.Sleep(time.Second * 2)
 	utils.LOG.Println("TCP exit!!!!")
 }
 
+// closeUpstream closes the upstream connection after the tun side failed,
+// a reset by the client is passed on as a reset.
+func closeUpstream(con net.Conn, err error) {
+	if errors.Is(err, syscall.ECONNRESET) {
+		if l, ok := con.(interface{ SetLinger(int) error }); ok {
+			l.SetLinger(0)
+		}
+	}
+	con.Close()
+}
+
+// closeWrite half-closes an upstream connection, connections without
+// half-close support are closed.
+func closeWrite(con net.Conn) {
+	if cw, ok := con.(interface{ CloseWrite() error }); ok {
+		cw.CloseWrite()
+		return
+	}
+	con.Close()
+}
+
 var gcache = dns.NewDNSCache()
 
 func settimeout(con net.Conn, second int) {
@@ -143,6 +198,7 @@ func handUDPConnection(c *netcore.UDPConnection, url string, dns string) {
 	}()
 
 	settimeout(con, 120) // set timeout
+	settimeout(c, 120)
 
 	buf := make([]byte, 4096)
 	n, err := c.Read(buf[:4000])
@@ -153,7 +209,7 @@ func handUDPConnection(c *netcore.UDPConnection, url string, dns string) {
 
 	utils.LOG.Print("UDP READ: ", n)
 
-	if strings.Contains(c.RemoteAddr().String(), dns) {
+	if strings.Contains(c.LocalAddr().String(), dns) {
 		answer := gcache.Query(buf[:n])
 		if answer != nil {
 			data, e := answer.PackBuffer(buf[:])
@@ -167,7 +223,7 @@ func handUDPConnection(c *netcore.UDPConnection, url string, dns string) {
 		}
 	}
 
-	v := packUDPHeader(buf[:n], c.RemoteAddr())
+	v := packUDPHeader(buf[:n], c.LocalAddr())
 	_, err = con.Write(v)
 	if err != nil {
 		utils.LOG.Println("write udp to proxy failed", err)
@@ -181,7 +237,7 @@ func handUDPConnection(c *netcore.UDPConnection, url string, dns string) {
 	}
 
 	raw := buf[:n]
-	if strings.Contains(c.RemoteAddr().String(), dns) {
+	if strings.Contains(c.LocalAddr().String(), dns) {
 		gcache.Store(raw)
 	}
 
@@ -206,8 +262,17 @@ func packUDPHeader(b []byte, addr net.Addr) []byte {
 	return out.Bytes()
 }
 
-// StopService ...
+// StopService shuts the stack down without waiting for slow peers, so it
+// can be called from the UI thread.
 func StopService() {
-	gstack.Close()
+	if gstack == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), stopTimeout)
+	defer cancel()
+	result, err := gstack.Shutdown(ctx)
+	if err != nil && result != nil {
+		utils.LOG.Println("stack shut down, force closed:", len(result.ForceClosed), err)
+	}
 	gstack = nil
 }
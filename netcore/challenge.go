@@ -0,0 +1,89 @@
+package netcore
+
+import (
+	"sync"
+	"time"
+
+	"github.com/Evan2698/netstackm/tcp"
+)
+
+const (
+	// DefaultChallengeACKLimit is the number of challenge acks the stack
+	// sends per second (RFC 5961 section 7).
+	DefaultChallengeACKLimit = 1000
+	// DefaultResetLimit is the number of RSTs the stack sends per second in
+	// answer to segments of unknown flows.
+	DefaultResetLimit = 1000
+)
+
+// rateLimiter allows a number of events per second, a limit of zero or
+// less disables it.
+type rateLimiter struct {
+	mu    sync.Mutex
+	limit int
+	start time.Time
+	count int
+}
+
+func newRateLimiter(limit int) *rateLimiter {
+	return &rateLimiter{limit: limit}
+}
+
+func (l *rateLimiter) setLimit(limit int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.limit = limit
+}
+
+// allow reports whether one more event fits into the current second.
+func (l *rateLimiter) allow() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.limit <= 0 {
+		return true
+	}
+	now := time.Now()
+	if now.Sub(l.start) >= time.Second {
+		l.start = now
+		l.count = 0
+	}
+	if l.count >= l.limit {
+		return false
+	}
+	l.count++
+	return true
+}
+
+// SetChallengeACKLimit sets the number of challenge acks sent per second
+// over all connections, zero or less removes the limit.
+func (s *Stack) SetChallengeACKLimit(n int) {
+	s.challenge.setLimit(n)
+}
+
+// SetResetLimit sets the number of RSTs sent per second in answer to
+// segments of unknown flows, zero or less removes the limit. It is kept
+// apart from the challenge ack limit so that one can not be used to probe
+// the other.
+func (s *Stack) SetResetLimit(n int) {
+	s.resets.setLimit(n)
+}
+
+// challengeACK sends an ack carrying the current RecvNext unless the stack
+// exceeded its challenge ack limit. The caller must hold the state lock.
+func (c *Connection) challengeACK() {
+	if !c.Stack.challenge.allow() {
+		return
+	}
+	r := ack(c.current)
+	c.Stack.SendTo(packtcp(r))
+}
+
+// refuse answers a segment of an unknown flow with a RST, subject to the
+// reset limit.
+func (s *Stack) refuse(pkt *tcp.TCP) {
+	if !s.resets.allow() {
+		return
+	}
+	relay := rst(pkt.SrcIP, pkt.DstIP, pkt.SrcPort, pkt.DstPort, pkt.Sequence, pkt.Acknowledgment, uint32(len(pkt.Payload)))
+	s.SendTo(packtcp(relay))
+}
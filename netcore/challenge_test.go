@@ -0,0 +1,52 @@
+package netcore
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	l := newRateLimiter(2)
+	if !l.allow() || !l.allow() || l.allow() {
+		t.Fatal("expected two events per second")
+	}
+	l.setLimit(0)
+	if !l.allow() {
+		t.Fatal("a zero limit must not block")
+	}
+}
+
+func TestChallengeACK(t *testing.T) {
+	s, ep := newTestStack(t)
+	defer ep.Close()
+	s.SetChallengeACKLimit(2)
+
+	p := newPeer(t, ep, 1000)
+	p.handshake()
+	if _, err := s.Accept(); err != nil {
+		t.Fatal(err)
+	}
+
+	syn := p.segment()
+	syn.SYN = true
+	syn.Sequence = p.seq + 10
+	p.send(syn)
+	if challenge := p.recv(); challenge.SYN || challenge.RST || challenge.Acknowledgment != p.seq {
+		t.Fatal("expected a challenge ack", challenge.Acknowledgment)
+	}
+
+	for i := 0; i < 2; i++ {
+		blind := p.segment()
+		blind.RST = true
+		blind.Sequence = p.seq + 10
+		p.send(blind)
+	}
+	if challenge := p.recv(); challenge.Acknowledgment != p.seq {
+		t.Fatal("expected a challenge ack", challenge.Acknowledgment)
+	}
+	select {
+	case <-ep.Outbound():
+		t.Fatal("the challenge ack limit was exceeded")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
@@ -2,12 +2,13 @@ package netcore
 
 import (
 	"errors"
-	"fmt"
 	"io"
 	"net"
+	"os"
+	"sync"
+	"syscall"
 
 	"github.com/Evan2698/netstackm/common"
-	"github.com/Evan2698/netstackm/ipv4"
 
 	"github.com/Evan2698/chimney/utils"
 
@@ -16,10 +17,19 @@ import (
 	"github.com/Evan2698/netstackm/tcp"
 )
 
+// ErrConnectionReset is returned by Read and Write after the peer reset the
+// connection.
+var ErrConnectionReset = os.NewSyscallError("tcp", syscall.ECONNRESET)
+
 // Connection ...
 type Connection struct {
 	closed  bool
 	closing bool
+	// the peer sent its FIN
+	eof bool
+	// half-closed by CloseRead and CloseWrite
+	rdClosed bool
+	wrClosed bool
 
 	Src, Dst                    net.IP
 	SourcePort, DestinationPort uint16
@@ -31,10 +41,43 @@ type Connection struct {
 	buffer []byte
 
 	Recv chan bool
+
+	writable chan bool
+
+	done chan struct{}
+	once sync.Once
+	err  error
+
+	// read and write deadlines
+	rd *deadline
+	wd *deadline
+
+	// opened by DialTCP, established is closed once the handshake is done
+	active      bool
+	established chan struct{}
+
+	// the listener of a passive open, nil for Accept
+	listener *Listener
+
+	// data not sent yet and the socket options controlling it
+	sndBuf     []byte
+	sndBufSize int
+	noDelay    bool
+	smallSent  bool
+	smallEnd   seqnum
+	linger     int
+	finQueued  bool
+	finSent    bool
 }
 
-// LocalAddr returns the local network address.
+var _ net.Conn = (*Connection)(nil)
+
+// LocalAddr returns the local network address. Src is the tun-side host,
+// which is the local end of accepted connections only.
 func (c *Connection) LocalAddr() net.Addr {
+	if c.active {
+		return &net.TCPAddr{IP: c.Dst, Port: int(c.DestinationPort)}
+	}
 	return &net.TCPAddr{
 		IP:   c.Src,
 		Port: int(c.SourcePort),
@@ -44,6 +87,9 @@ func (c *Connection) LocalAddr() net.Addr {
 
 // RemoteAddr returns the remote network address.
 func (c *Connection) RemoteAddr() net.Addr {
+	if c.active {
+		return &net.TCPAddr{IP: c.Src, Port: int(c.SourcePort)}
+	}
 	return &net.TCPAddr{
 		IP:   c.Dst,
 		Port: int(c.DestinationPort),
@@ -51,72 +97,106 @@ func (c *Connection) RemoteAddr() net.Addr {
 	}
 }
 
-// Read return n indicate byte numbers.
+// Read return n indicate byte numbers. It fails with a timeout error once
+// the read deadline has passed.
 func (c *Connection) Read(b []byte) (n int, err error) {
-	// clear out current buffer
-
-	if c.closed || c.closing {
-		return 0, errors.New(SocketClosed.String())
-	}
-
 	state := c.current
-	if len(c.buffer) > 0 {
-		state.lockObject.Lock()
-		n := copy(b, c.buffer[:])
-		c.buffer = c.buffer[n:]
-		state.recvWindow = 64420
-		state.lockObject.Unlock()
-
-		return n, nil
-	}
+	for {
+		expired := c.rd.wait()
+		select {
+		case <-expired:
+			return 0, c.timeout("read")
+		default:
+		}
 
-	select {
-	case <-time.After(60 * time.Minute):
-		fmt.Println("Timeout occured")
-		return 0, errors.New("Timeout occured.")
-	case _, ok := <-c.Recv:
-		if !ok {
-			// connection closed?
+		state.lockObject.Lock()
+		if len(c.buffer) > 0 {
+			n = copy(b, c.buffer[:])
+			c.buffer = c.buffer[n:]
 			if len(c.buffer) == 0 {
-				return 0, io.EOF
+				c.buffer = nil
 			}
+			c.windowUpdate()
+			state.lockObject.Unlock()
+			return n, nil
 		}
-		state.lockObject.Lock()
-		n = copy(b[:], c.buffer[:])
-		c.buffer = c.buffer[n:]
-		state.recvWindow = 64420
+		err = c.readError()
 		state.lockObject.Unlock()
-		return n, nil
+		if err != nil {
+			return 0, err
+		}
+
+		select {
+		case <-expired:
+		case <-c.Recv:
+		case <-c.done:
+		}
 	}
 }
 
-// Write writes data to the connection.
-// Write can be made to time out and return a Error with Timeout() == true
-// after a fixed time limit; see SetDeadline and SetWriteDeadline.
+// readError returns the error of a read on an empty buffer, nil when the
+// read has to wait. The caller must hold the state lock.
+func (c *Connection) readError() error {
+	switch {
+	case c.closing:
+		return c.closedError("read")
+	case c.eof || c.rdClosed:
+		return io.EOF
+	case c.closed && c.err != nil:
+		return c.err
+	case c.closed:
+		return io.EOF
+	}
+	return nil
+}
+
+// Write copies data into the send buffer and sends what the windows allow.
+// It blocks while the buffer is full and fails with a timeout error once the
+// write deadline has passed.
 func (c *Connection) Write(b []byte) (n int, err error) {
+	state := c.current
+	state.lockObject.Lock()
 	if c.closed || c.closing {
-		return 0, errors.New(SocketClosed.String())
+		err = c.closedError("write")
+	}
+	state.lockObject.Unlock()
+	if err != nil {
+		return 0, err
 	}
 
-	state := c.current
-	sz := len(b)
 	rest := b
-	var data []byte
-	standard := ipv4.MTU - 40
-	for sz > 0 {
+	for len(rest) > 0 {
+		expired := c.wd.wait()
+		select {
+		case <-expired:
+			return len(b) - len(rest), c.timeout("write")
+		default:
+		}
+
 		state.lockObject.Lock()
-		if sz > standard {
-			data = rest[:standard]
-			rest = rest[standard:]
-		} else {
-			data = rest
-			rest = nil
+		if c.closed || c.closing || c.wrClosed {
+			state.lockObject.Unlock()
+			return len(b) - len(rest), c.closedError("write")
 		}
-		r := payload(state, data)
-		c.Stack.SendTo(packtcp(r))
-		state.SendNext += uint32(len(data))
-		state.sendWindow = 64420
-		sz = len(rest)
+
+		free := c.sndBufSize - len(c.sndBuf)
+		if free <= 0 {
+			state.lockObject.Unlock()
+			select {
+			case <-c.writable:
+			case <-c.done:
+			case <-expired:
+			}
+			continue
+		}
+
+		sz := len(rest)
+		if sz > free {
+			sz = free
+		}
+		c.sndBuf = append(c.sndBuf, rest[:sz]...)
+		rest = rest[sz:]
+		c.flush()
 		state.lockObject.Unlock()
 	}
 
@@ -125,8 +205,11 @@ func (c *Connection) Write(b []byte) (n int, err error) {
 
 // Open ...
 func (c *Connection) Open(t *tcp.TCP) error {
+	return c.open(t, c.Stack.newISS())
+}
 
-	sendNext := uint32(c.Stack.r.Int31n(2147483))
+// open is Open with the initial send sequence number sendNext.
+func (c *Connection) open(t *tcp.TCP, sendNext seqnum) error {
 	state := &State{
 		SrcPort:  t.SrcPort,
 		DestPort: t.DstPort,
@@ -134,28 +217,42 @@ func (c *Connection) Open(t *tcp.TCP) error {
 		SrcIP:  t.SrcIP,
 		DestIP: t.DstIP,
 
-		Last:     time.Now(),
-		RecvNext: t.Sequence + 1,
-		SendNext: sendNext,
+		Last:               time.Now(),
+		RecvNext:           seqnum(t.Sequence).add(1),
+		SendNext:           sendNext,
+		SendUnAcknowledged: sendNext,
+		highSacked:         sendNext,
+		rto:                InitialRTO,
+		tsOffset:           c.Stack.random(),
 
-		sendWindow: uint32(MAX_SEND_WINDOW),
-		recvWindow: uint32(MAX_RECV_WINDOW),
+		sendWindow: uint32(t.WndSize),
+		sndWl1:     seqnum(t.Sequence),
 
-		Conn: c,
+		SocketState: SocketListen,
+		Conn:        c,
 	}
 
+	state.lockObject.Lock()
+	defer state.lockObject.Unlock()
+	c.current = state
+	c.Stack.ackConfig(state)
+	return c.handleListen(t)
+}
+
+// handleListen answers the SYN which created the connection and moves it
+// from LISTEN to SYN_RECEIVED. The caller must hold the state lock.
+func (c *Connection) handleListen(t *tcp.TCP) error {
+	state := c.current
+	c.setReceiveBuffer(c.Stack.receiveBufferSize())
+	c.negotiate(t)
+	state.cc = c.Stack.newCongestionControl(state.sendMSS)
 	err := c.Stack.t.Add(t.SrcIP, t.DstIP, t.SrcPort, t.DstPort, state)
 	if err != nil {
 		utils.LOG.Println("can not create state ", err)
 		return err
 	}
-	state.lockObject.Lock()
-	defer state.lockObject.Unlock()
-	c.current = state
-	x := synack(state)
-	v := packtcp(x)
-	c.Stack.SendTo(v)
-	c.current.SendNext = c.current.SendNext + 1
+	c.sendSegment(&segment{seq: state.SendNext, syn: true})
+	c.current.SendNext = c.current.SendNext.add(1)
 	state.SocketState = SocketSynReceived
 	return nil
 }
@@ -167,17 +264,63 @@ func (c *Connection) run(t *tcp.TCP) {
 		return
 	}
 
+	state := c.current
+	state.lockObject.Lock()
+	defer state.lockObject.Unlock()
+	// acks and window updates may let buffered data go
+	defer c.flush()
+	state.Last = time.Now()
+	state.keepAliveProbes = 0
+
 	utils.LOG.Println("connection: ",
 		common.GenerateUniqueKey(c.Src, c.Dst, c.SourcePort, c.DestinationPort),
-		"current state: ", c.current.SocketState.String())
+		"current state: ", state.SocketState.String())
 
+	if state.SocketState == SocketSynSent {
+		c.handleSynSent(t)
+		return
+	}
+	if t.SYN && !t.ACK && state.SocketState == SocketTimeWait {
+		// ahead of PAWS, the clock of a new connection may lag
+		c.handleTimeWaitSYN(t)
+		return
+	}
+	if !c.checkTimestamps(t) {
+		return
+	}
+	if t.RST {
+		c.handleReset(t)
+		return
+	}
+	if t.SYN && state.SocketState != SocketSynReceived {
+		// RFC 5961 section 4, a SYN on a synchronized connection is never
+		// acted on, a peer which really restarted answers the challenge
+		// ack with a RST
+		c.challengeACK()
+		return
+	}
+	// RFC 793 section 3.9, a segment outside the receive window is
+	// acknowledged and dropped before its ack and window are looked at
+	if !t.SYN && state.SocketState != SocketTimeWait && state.SocketState != SocketClosed && !c.acceptable(t) {
+		r := ack(state)
+		c.Stack.SendTo(packtcp(r))
+		return
+	}
+	// a window update is no duplicate ack
+	wnd := state.sendWindow
 	c.updateWindow(t)
+	if t.ACK {
+		c.processSACK(t)
+		c.processAck(t, wnd)
+	}
 
 	switch c.current.SocketState {
 	case SocketSynReceived:
 		c.handleSynRecived(t)
 	case SocketEstablished:
 		c.handleEstablished(t)
+	case SocketCloseWait:
+		c.handleCloseWait(t)
 	case SocketFinWait1:
 		c.handleFinWait1(t)
 	case SocketFinWait2:
@@ -187,244 +330,434 @@ func (c *Connection) run(t *tcp.TCP) {
 	case SocketLastAck:
 		c.handleLastAck(t)
 		return
+	case SocketTimeWait:
+		c.handleTimeWait(t)
+	case SocketClosed:
+		return
 	default:
 		utils.LOG.Println("unhandle state: ", c.current.SocketState.String())
 	}
 
 }
-func (c *Connection) updateWindow(t *tcp.TCP) {
-	state := c.current
-	state.lockObject.Lock()
-	defer state.lockObject.Unlock()
-	state.sendWindow = uint32(t.WndSize)
-}
-
-func (c *Connection) handleLastAck(t *tcp.TCP) {
 
-	c.handleclosed()
+// handleReset processes an inbound RST as described in RFC 5961 section 3.
+// Only a RST carrying exactly RecvNext aborts the connection, one elsewhere
+// in the receive window is answered with a challenge ack and any other is
+// dropped. The caller must hold the state lock.
+func (c *Connection) handleReset(t *tcp.TCP) {
 	state := c.current
-	if !validAck(state.SendNext, t.Acknowledgment) || !validSeq(t.Sequence, state.RecvNext) {
-		utils.LOG.Println("valid failed in handleFinWait2")
+	switch state.SocketState {
+	case SocketClosed, SocketTimeWait:
+		// RFC 1337, a RST must not cut TIME_WAIT short
 		return
 	}
 
-	if !t.ACK {
+	if seq := seqnum(t.Sequence); seq != state.RecvNext {
+		if seq.inWindow(state.RecvNext, state.advertised) {
+			c.challengeACK()
+		}
 		return
 	}
 
-	state.lockObject.Lock()
-	state.SocketState = SocketClosed
-	state.lockObject.Unlock()
+	utils.LOG.Println(common.GenerateUniqueKey(c.Src, c.Dst, c.SourcePort, c.DestinationPort),
+		"connection reset by peer in", state.SocketState.String())
+	c.terminate(ErrConnectionReset)
 }
 
-func (c *Connection) handleClosing(t *tcp.TCP) {
-
-	state := c.current
-	if !validAck(state.SendNext, t.Acknowledgment) || !validSeq(t.Sequence, state.RecvNext) {
-		utils.LOG.Println("valid failed in handleFinWait2")
+func (c *Connection) handleLastAck(t *tcp.TCP) {
+	// processAck has taken the ack already
+	if !t.ACK || !c.finAcked() || !c.acceptable(t) {
+		utils.LOG.Println("valid failed in handleLastAck")
 		return
 	}
 
-	if t.RST {
-		return
-	}
+	c.handleclosed()
+}
 
-	if !t.ACK {
+func (c *Connection) handleClosing(t *tcp.TCP) {
+	if !t.ACK || !c.finAcked() || !c.acceptable(t) {
+		utils.LOG.Println("valid failed in handleClosing")
 		return
 	}
-	state.lockObject.Lock()
-	defer state.lockObject.Unlock()
-	state.SocketState = SocketTimeWait
+
+	c.enterTimeWait()
 }
 
-func (c *Connection) handleFinWait2(t *tcp.TCP) {
+// acceptable is the segment acceptance test of RFC 793 section 3.3: some of
+// the sequence space occupied by t lies in the receive window, with a zero
+// window only an empty segment at RecvNext is acceptable. The caller must
+// hold the state lock.
+func (c *Connection) acceptable(t *tcp.TCP) bool {
 	state := c.current
-	if !validAck(state.SendNext, t.Acknowledgment) || !validSeq(t.Sequence, state.RecvNext) {
-		utils.LOG.Println("valid failed in handleFinWait2")
-		return
+	seq := seqnum(t.Sequence)
+	n := uint32(len(t.Payload))
+	if t.SYN {
+		n++
 	}
-
-	if t.RST {
-		return
+	if t.FIN {
+		n++
 	}
 
-	if !t.ACK || !t.FIN {
-		return
+	wnd := state.advertised
+	switch {
+	case n == 0 && wnd == 0:
+		return seq == state.RecvNext
+	case n == 0:
+		return seq.inWindow(state.RecvNext, wnd)
+	case wnd == 0:
+		return false
 	}
-
-	state.lockObject.Lock()
-	defer state.lockObject.Unlock()
-	state.RecvNext = state.RecvNext + 1
-	r := ack(c.current)
-	c.Stack.SendTo(packtcp(r))
-	state.SocketState = SocketTimeWait
+	return seq.inWindow(state.RecvNext, wnd) || seq.add(n-1).inWindow(state.RecvNext, wnd)
 }
 
-func (c *Connection) handleFinWait1(t *tcp.TCP) {
-	if !validSeq(t.Sequence, c.current.RecvNext) {
+func (c *Connection) handleFinWait2(t *tcp.TCP) {
+	if !t.ACK {
 		return
 	}
 
-	// connection ends by valid RST
-	if t.RST {
-		return
+	// the peer may keep sending after our FIN
+	if c.receive(t) {
+		c.enterTimeWait()
 	}
+}
+
+func (c *Connection) handleFinWait1(t *tcp.TCP) {
 	// ignore non-ACK packets
 	if !t.ACK {
 		return
 	}
 
 	state := c.current
-	state.lockObject.Lock()
-	defer state.lockObject.Unlock()
-	if t.FIN {
-		state.RecvNext = state.RecvNext + 1
-		r := ack(c.current)
-		c.Stack.SendTo(packtcp(r))
-		if t.ACK && validAck(state.SendNext, t.Acknowledgment) {
-			state.SocketState = SocketTimeWait
-			return
-		}
+	fin := c.receive(t)
+	// processAck has taken the ack already
+	finAcked := c.finAcked()
+	switch {
+	case fin && finAcked:
+		c.enterTimeWait()
+	case fin:
 		state.SocketState = SocketClosing
-		c.closing = true
-		return
-
+	case finAcked:
+		state.SocketState = SocketFinWait2
 	}
-	state.SocketState = SocketFinWait2
 }
 
 func (c *Connection) handleEstablished(t *tcp.TCP) {
 
-	if !validSeq(t.Sequence, c.current.RecvNext) {
+	state := c.current
+	// ignore non-ACK packets
+	if !t.ACK {
 		r := ack(c.current)
 		c.Stack.SendTo(packtcp(r))
 		return
 	}
 
-	// connection ends by valid RST
-	if t.RST {
-		utils.LOG.Print("OPPPPPSS RST")
-		//c.notifyclose()
-		return
+	if c.receive(t) {
+		// the peer is done sending, our side stays open until the
+		// application closes it
+		state.SocketState = SocketCloseWait
 	}
-	// ignore non-ACK packets
-	if !t.ACK {
-		r := ack(c.current)
+}
+
+// receive takes the data and FIN carried by t in the states which accept
+// data. It reports whether the peer's FIN was consumed, which is
+// acknowledged at once. The caller must hold the state lock.
+func (c *Connection) receive(t *tcp.TCP) bool {
+	state := c.current
+	c.measureSegment(len(t.Payload))
+	data, fin, filled, ok := c.reassemble(t)
+	if !ok {
+		r := ack(state)
 		c.Stack.SendTo(packtcp(r))
-		return
+		return false
 	}
 
-	state := c.current
-	pl := len(t.Payload)
-	state.lockObject.Lock()
-	defer state.lockObject.Unlock()
-	if pl > 0 {
-		state.RecvNext = state.RecvNext + uint32(pl)
-		state.recvWindow = 64420
-		state.Conn.buffer = append(state.Conn.buffer, t.Payload[:]...)
-		select {
-		case c.Recv <- true:
-		default:
+	if len(data) > 0 {
+		state.RecvNext = state.RecvNext.add(uint32(len(data)))
+		c.deliver(data)
+	}
+	if !fin {
+		if filled {
+			// the gap is filled, acknowledge at once
+			r := ack(state)
+			c.Stack.SendTo(packtcp(r))
+		} else if len(data) > 0 {
+			c.scheduleACK(len(data), t.PSH)
 		}
+		return false
 	}
-	// ack
-	//ak := ack(state)
-	//c.Stack.sendtolow(packtcp(ak), true)
-	//------------------------------
 
-	if t.FIN {
-		state.RecvNext = state.RecvNext + 1
-		r := finAck(state)
+	state.RecvNext = state.RecvNext.add(1)
+	r := ack(state)
+	c.Stack.SendTo(packtcp(r))
+	c.eof = true
+	select {
+	case c.Recv <- true:
+	default:
+	}
+	return true
+}
+
+// handleCloseWait handles segments after the peer's FIN. Acks of our data
+// are processed by run, anything occupying sequence space is a
+// retransmission and acknowledged again.
+func (c *Connection) handleCloseWait(t *tcp.TCP) {
+	if len(t.Payload) > 0 || t.FIN {
+		r := ack(c.current)
 		c.Stack.SendTo(packtcp(r))
-		state.SendNext = state.SendNext + 1
-		state.SocketState = SocketLastAck
 	}
 }
 
-func (c *Connection) handleSynRecived(t *tcp.TCP) {
+// reassemble returns the in-order data and FIN flag carried by t together
+// with the queued segments it makes contiguous, filled reports that queued
+// data was used. Segments ahead of RecvNext are queued and ok is false, the
+// caller then sends a duplicate ack. The caller must hold the state lock.
+func (c *Connection) reassemble(t *tcp.TCP) (data []byte, fin bool, filled bool, ok bool) {
 	state := c.current
-	if !validAck(state.SendNext, t.Acknowledgment) || !validSeq(t.Sequence, state.RecvNext) {
-		utils.LOG.Println("valid failed")
-		if !t.RST {
-			r := rst(t.SrcIP, t.DstIP, t.SrcPort, t.DstPort, t.Sequence, t.Acknowledgment, uint32(len(t.Payload)))
-			c.Stack.SendTo(packtcp(r))
+	seq := seqnum(t.Sequence)
+	data = t.Payload
+	fin = t.FIN
+
+	// trim bytes we already have
+	if seq.lessThan(state.RecvNext) {
+		d := seq.size(state.RecvNext)
+		if int(d) > len(data) || (int(d) == len(data) && !fin) {
+			return nil, false, false, false
 		}
-		return
+		data = data[d:]
+		seq = state.RecvNext
 	}
 
-	if t.RST {
-		utils.LOG.Println("ignore this packet", state.SocketState.String())
-		t.Dump()
-		//c.notifyclose()
+	if seq != state.RecvNext {
+		if seq.inWindow(state.RecvNext, state.recvWindow) && (len(data) > 0 || fin) {
+			if !state.ooo.insert(state.RecvNext, seq, data, fin) {
+				utils.LOG.Println("out-of-order queue is full, drop segment")
+			}
+		}
+		return nil, false, false, false
+	}
+
+	// never take more than the window we offered
+	if uint32(len(data)) > state.recvWindow {
+		data = data[:state.recvWindow]
+		fin = false
+		if len(data) == 0 {
+			return nil, false, false, false
+		}
+	}
+
+	if state.ooo.empty() || fin {
+		return data, fin, false, true
+	}
+
+	more, morefin := state.ooo.pop(seq.add(uint32(len(data))))
+	if len(more) > 0 {
+		data = append(append([]byte{}, data...), more...)
+	}
+	return data, morefin, true, true
+}
+
+// deliver appends in-order data to the receive buffer and wakes a reader,
+// after CloseRead the data is acknowledged and dropped. The caller must
+// hold the state lock.
+func (c *Connection) deliver(data []byte) {
+	if c.rdClosed {
 		return
 	}
+	c.buffer = append(c.buffer, data...)
+	c.updateRecvWindow()
+	select {
+	case c.Recv <- true:
+	default:
+	}
+}
 
+func (c *Connection) handleSynRecived(t *tcp.TCP) {
+	state := c.current
+	if t.SYN && !t.ACK && seqnum(t.Sequence).add(1) == state.RecvNext {
+		// the peer lost our SYN-ACK and sent its SYN again
+		if len(state.unacked) > 0 {
+			c.Stack.SendTo(packtcp(state.unacked[0].build(state)))
+		}
+		return
+	}
 	if !t.ACK {
 		utils.LOG.Println("ignore this packet")
 		t.Dump()
 		return
 	}
-
-	pl := len(t.Payload)
-
-	state.lockObject.Lock()
-	defer state.lockObject.Unlock()
-
-	if pl > 0 {
-
-		state.recvWindow = 64420
-		state.Conn.buffer = append(state.Conn.buffer, t.Payload[:]...)
+	// only an ack of our SYN completes the handshake (RFC 793 section 3.9)
+	if seqnum(t.Acknowledgment) != state.SendNext {
+		utils.LOG.Println("valid failed")
+		r := rst(t.SrcIP, t.DstIP, t.SrcPort, t.DstPort, t.Sequence, t.Acknowledgment, uint32(len(t.Payload)))
+		c.Stack.SendTo(packtcp(r))
+		return
 	}
 
-	ac := ack(state)
-	c.Stack.SendTo(packtcp(ac))
-	state.RecvNext = state.RecvNext + uint32(pl)
 	state.SocketState = SocketEstablished
-	c.Stack.a <- c
+	if c.receive(t) {
+		state.SocketState = SocketCloseWait
+	}
+	if !c.enqueue() {
+		return
+	}
 	select {
 	case c.Recv <- true:
 	default:
 	}
 }
 
+// closedError returns the error of op on a closed connection, the reason
+// of an abort or net.ErrClosed after a local Close, as net.Conn has it.
+func (c *Connection) closedError(op string) error {
+	if c.err != nil && !c.closing {
+		return c.err
+	}
+	return &net.OpError{
+		Op:     op,
+		Net:    "tcp",
+		Source: c.LocalAddr(),
+		Addr:   c.RemoteAddr(),
+		Err:    net.ErrClosed,
+	}
+}
+
 func (c *Connection) handleclosed() {
-	c.closed = true
 	utils.LOG.Println("notify close action!!!")
-	c.Stack.t.Remove(c.Src, c.Dst, c.SourcePort, c.DestinationPort)
+	c.terminate(nil)
+}
+
+// terminate moves the connection to closed, removes it from the state table
+// and wakes blocked Read and Write calls, which then return err (io.EOF
+// when err is nil). The caller must hold the state lock.
+func (c *Connection) terminate(err error) {
+	c.once.Do(func() {
+		c.err = err
+		c.closed = true
+		if c.current.SocketState == SocketTimeWait {
+			c.Stack.releaseTimeWait()
+		}
+		c.current.SocketState = SocketClosed
+		c.stopRetransmit()
+		c.stopPersist()
+		c.stopKeepAlive()
+		c.stopDelayedACK()
+		c.stopTimeWait()
+		// gone before anyone woken below looks, the 4-tuple may
+		// belong to a new connection already
+		c.Stack.t.RemoveState(c.Src, c.Dst, c.SourcePort, c.DestinationPort, c.current)
+		close(c.done)
+	})
+}
+
+// abort sends a RST to the peer and terminates the connection. The caller
+// must hold the state lock.
+func (c *Connection) abort(err error) {
+	if c.closed {
+		return
+	}
+	r := reset(c.current)
+	c.Stack.SendTo(packtcp(r))
+	c.terminate(err)
 }
 
 func (c *Connection) notifyclose() {
 	state := c.current
 	state.lockObject.Lock()
-	state.RecvNext = state.RecvNext + 1
-	t := finAck(state)
-	c.Stack.SendTo(packtcp(t))
-	state.SendNext = state.SendNext + 1
-	state.SocketState = SocketFinWait1
-	state.lockObject.Unlock()
+	defer state.lockObject.Unlock()
+	c.closeLocked()
 }
 
-func (c *Connection) dispatch(t *tcp.TCP) {
-	c.run(t)
+// closeLocked queues our FIN behind the buffered data. Established
+// connections start the active close, in CLOSE_WAIT the passive close
+// completes in LAST_ACK. Handshakes in progress are reset.
+func (c *Connection) closeLocked() {
+	state := c.current
+	switch state.SocketState {
+	case SocketEstablished:
+		c.finQueued = true
+		state.SocketState = SocketFinWait1
+		c.flush()
+	case SocketCloseWait:
+		c.finQueued = true
+		state.SocketState = SocketLastAck
+		c.flush()
+	case SocketListen, SocketSynReceived, SocketSynSent:
+		c.abort(errors.New(SocketClosed.String()))
+	}
 }
 
-//Close ...
-func (c *Connection) Close() {
-	utils.LOG.Print("close function was called by caller..")
-	if !c.closed {
-		c.notifyclose()
+// CloseWrite shuts down the writing side. Our FIN is sent once the queued
+// data is out, reading goes on until the peer closes its side.
+func (c *Connection) CloseWrite() error {
+	state := c.current
+	state.lockObject.Lock()
+	defer state.lockObject.Unlock()
+	if c.closed || c.closing {
+		return c.closedError("close")
+	}
+	if c.wrClosed {
+		return nil
+	}
+	c.wrClosed = true
+	c.closeLocked()
+	c.notifyWritable()
+	return nil
+}
+
+// CloseRead shuts down the reading side. Buffered and further inbound data
+// is discarded and Read returns io.EOF.
+func (c *Connection) CloseRead() error {
+	state := c.current
+	state.lockObject.Lock()
+	defer state.lockObject.Unlock()
+	if c.closed || c.closing {
+		return c.closedError("close")
 	}
+	c.rdClosed = true
+	c.buffer = nil
+	c.windowUpdate()
 	select {
 	case c.Recv <- true:
 	default:
 	}
-	time.Sleep(time.Second * 10)
+	return nil
+}
 
+func (c *Connection) dispatch(t *tcp.TCP) {
+	c.run(t)
+}
+
+// Close sends a FIN to the peer and returns at once, the close handshake
+// finishes in the background. Closing twice returns net.ErrClosed.
+func (c *Connection) Close() error {
+	utils.LOG.Print("close function was called by caller..")
 	state := c.current
 	state.lockObject.Lock()
-	defer state.lockObject.Unlock()
-	close(c.Recv)
+	if c.closing {
+		state.lockObject.Unlock()
+		return c.closedError("close")
+	}
+	c.closing = true
+	switch {
+	case c.closed:
+	case c.linger == 0:
+		c.abort(errors.New(SocketClosed.String()))
+	default:
+		c.closeLocked()
+	}
+	linger := c.linger
+	state.lockObject.Unlock()
+	if linger > 0 {
+		c.lingerWait(time.Duration(linger) * time.Second)
+	}
+
+	select {
+	case c.Recv <- true:
+	default:
+	}
+	c.notifyWritable()
 	utils.LOG.Println(common.GenerateUniqueKey(c.Src, c.Dst, c.SourcePort, c.DestinationPort), "TCP connection exit!!!!!")
+	return nil
 }
 
 // NewConnection ..
@@ -436,7 +769,13 @@ func NewConnection(src, dst net.IP, sport, dport uint16, s *Stack) *Connection {
 		SourcePort:      sport,
 		DestinationPort: dport,
 		Stack:           s,
-		Recv:            make(chan bool),
+		Recv:            make(chan bool, 1),
+		writable:        make(chan bool, 1),
+		done:            make(chan struct{}),
+		rd:              newDeadline(),
+		wd:              newDeadline(),
+		sndBufSize:      DefaultSendBufferSize,
+		linger:          -1,
 	}
 
 	return v
@@ -0,0 +1,93 @@
+package netcore
+
+import (
+	"errors"
+	"sort"
+	"time"
+)
+
+const (
+	// DefaultCongestionControl is the algorithm used unless the stack is
+	// configured otherwise.
+	DefaultCongestionControl = "cubic"
+)
+
+// CongestionControl decides how many bytes a connection may have in flight.
+// All methods are called with the state lock held.
+type CongestionControl interface {
+	// OnAck is called when acked bytes of new data are acknowledged outside
+	// of loss recovery, rtt is the smoothed round trip time.
+	OnAck(acked int, rtt time.Duration)
+	// OnLoss is called when a lost segment is detected by duplicate acks.
+	OnLoss(inFlight int)
+	// OnTimeout is called when the retransmission timer expires.
+	OnTimeout(inFlight int)
+	// Window returns the congestion window in bytes.
+	Window() int
+	// Threshold returns the slow start threshold in bytes.
+	Threshold() int
+}
+
+// CongestionFactory creates the congestion control of one connection.
+type CongestionFactory func(mss int) CongestionControl
+
+var congestionAlgorithms = map[string]CongestionFactory{
+	"newreno": NewNewReno,
+	"cubic":   NewCubic,
+}
+
+// CongestionAlgorithms returns the names accepted by SetCongestionControl.
+func CongestionAlgorithms() []string {
+	names := make([]string, 0, len(congestionAlgorithms))
+	for k := range congestionAlgorithms {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// SetCongestionControl selects the congestion control algorithm of new
+// connections, see CongestionAlgorithms.
+func (s *Stack) SetCongestionControl(name string) error {
+	if _, ok := congestionAlgorithms[name]; !ok {
+		return errors.New("unknown congestion control: " + name)
+	}
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.congestion = name
+	return nil
+}
+
+func (s *Stack) newCongestionControl(mss int) CongestionControl {
+	s.m.Lock()
+	name := s.congestion
+	s.m.Unlock()
+
+	f, ok := congestionAlgorithms[name]
+	if !ok {
+		f = congestionAlgorithms[DefaultCongestionControl]
+	}
+	return f(mss)
+}
+
+// initialWindow returns the initial congestion window of RFC 5681.
+func initialWindow(mss int) int {
+	switch {
+	case mss > 2190:
+		return 2 * mss
+	case mss > 1095:
+		return 3 * mss
+	default:
+		return 4 * mss
+	}
+}
+
+// lossThreshold returns the slow start threshold after a loss, RFC 5681
+// equation 4.
+func lossThreshold(inFlight, mss int) int {
+	t := inFlight / 2
+	if t < 2*mss {
+		t = 2 * mss
+	}
+	return t
+}
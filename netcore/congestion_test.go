@@ -0,0 +1,63 @@
+package netcore
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNewReno(t *testing.T) {
+	cc := NewNewReno(1000)
+	if cc.Window() != 4000 {
+		t.Fatal("unexpected initial window", cc.Window())
+	}
+
+	// slow start doubles the window per round trip
+	for i := 0; i < 4; i++ {
+		cc.OnAck(1000, 0)
+	}
+	if cc.Window() != 8000 {
+		t.Fatal("unexpected slow start window", cc.Window())
+	}
+
+	cc.OnLoss(6000)
+	if cc.Window() != 3000 || cc.Threshold() != 3000 {
+		t.Fatal("unexpected window after loss", cc.Window(), cc.Threshold())
+	}
+
+	// congestion avoidance grows one segment per window
+	cc.OnAck(1000, 0)
+	cc.OnAck(1000, 0)
+	if cc.Window() != 3000 {
+		t.Fatal("window grew too fast", cc.Window())
+	}
+	cc.OnAck(1000, 0)
+	if cc.Window() != 4000 {
+		t.Fatal("window did not grow", cc.Window())
+	}
+
+	cc.OnTimeout(4000)
+	if cc.Window() != 1000 || cc.Threshold() != 2000 {
+		t.Fatal("unexpected window after timeout", cc.Window(), cc.Threshold())
+	}
+}
+
+func TestCubic(t *testing.T) {
+	now := time.Unix(0, 0)
+	cc := NewCubic(1000).(*Cubic)
+	cc.now = func() time.Time { return now }
+	cc.cwnd = 100000
+
+	cc.OnLoss(100000)
+	if cc.Window() != 70000 {
+		t.Fatal("unexpected window after loss", cc.Window())
+	}
+
+	// the window recovers to wMax after K seconds and keeps growing
+	for i := 0; i < 400; i++ {
+		now = now.Add(20 * time.Millisecond)
+		cc.OnAck(1000, 20*time.Millisecond)
+	}
+	if cc.Window() <= 100000 {
+		t.Fatal("window did not recover", cc.Window())
+	}
+}
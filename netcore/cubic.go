@@ -0,0 +1,127 @@
+package netcore
+
+import (
+	"math"
+	"time"
+)
+
+const (
+	cubicC    = 0.4
+	cubicBeta = 0.7
+)
+
+// Cubic implements the congestion control of RFC 9438. Window arithmetic is
+// done in segments, the window reported to the connection is in bytes.
+type Cubic struct {
+	mss      int
+	cwnd     int
+	ssthresh int
+
+	wMax     float64
+	wLastMax float64
+	k        float64
+	origin   float64
+	wEst     float64
+	epoch    time.Time
+	grow     float64
+
+	now func() time.Time
+}
+
+// NewCubic ...
+func NewCubic(mss int) CongestionControl {
+	return &Cubic{
+		mss:      mss,
+		cwnd:     initialWindow(mss),
+		ssthresh: math.MaxInt32,
+		now:      time.Now,
+	}
+}
+
+// OnAck ...
+func (c *Cubic) OnAck(acked int, rtt time.Duration) {
+	if c.cwnd < c.ssthresh {
+		if acked > c.mss {
+			acked = c.mss
+		}
+		c.cwnd += acked
+		return
+	}
+
+	cwnd := float64(c.cwnd) / float64(c.mss)
+	now := c.now()
+	if c.epoch.IsZero() {
+		c.epoch = now
+		if cwnd < c.wMax {
+			c.k = math.Cbrt((c.wMax - cwnd) / cubicC)
+			c.origin = c.wMax
+		} else {
+			c.k = 0
+			c.origin = cwnd
+		}
+		c.wEst = cwnd
+	}
+
+	t := (now.Sub(c.epoch) + rtt).Seconds()
+	target := c.origin + cubicC*math.Pow(t-c.k, 3)
+
+	// the Reno-friendly region
+	c.wEst += 3 * (1 - cubicBeta) / (1 + cubicBeta) * float64(acked) / float64(c.cwnd)
+	if c.wEst > target {
+		target = c.wEst
+	}
+	if target > 1.5*cwnd {
+		target = 1.5 * cwnd
+	}
+
+	if target > cwnd {
+		c.grow += float64(acked) * (target - cwnd) / cwnd
+	} else {
+		c.grow += float64(acked) / (100 * cwnd)
+	}
+	if c.grow >= 1 {
+		c.cwnd += int(c.grow)
+		c.grow -= math.Floor(c.grow)
+	}
+}
+
+// OnLoss ...
+func (c *Cubic) OnLoss(inFlight int) {
+	c.reduce()
+	c.cwnd = c.ssthresh
+}
+
+// OnTimeout ...
+func (c *Cubic) OnTimeout(inFlight int) {
+	c.reduce()
+	c.cwnd = c.mss
+}
+
+func (c *Cubic) reduce() {
+	cwnd := float64(c.cwnd) / float64(c.mss)
+	// fast convergence
+	if cwnd < c.wLastMax {
+		c.wLastMax = cwnd
+		c.wMax = cwnd * (1 + cubicBeta) / 2
+	} else {
+		c.wLastMax = cwnd
+		c.wMax = cwnd
+	}
+
+	c.ssthresh = int(float64(c.cwnd) * cubicBeta)
+	if c.ssthresh < 2*c.mss {
+		c.ssthresh = 2 * c.mss
+	}
+	c.epoch = time.Time{}
+	c.grow = 0
+}
+
+// Window ...
+func (c *Cubic) Window() int {
+	return c.cwnd
+}
+
+// Threshold ...
+func (c *Cubic) Threshold() int {
+	return c.ssthresh
+}
@@ -0,0 +1,100 @@
+package netcore
+
+import (
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// deadline is a read or write deadline of a connection. The channel
+// returned by wait is closed once the deadline has passed.
+type deadline struct {
+	mu      sync.Mutex
+	timer   *time.Timer
+	expired chan struct{}
+}
+
+func newDeadline() *deadline {
+	return &deadline{expired: make(chan struct{})}
+}
+
+// set moves the deadline to t, the zero time disables it.
+func (d *deadline) set(t time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.timer != nil && !d.timer.Stop() {
+		// the timer fired, wait until it closed the channel
+		<-d.expired
+	}
+	d.timer = nil
+
+	closed := false
+	select {
+	case <-d.expired:
+		closed = true
+	default:
+	}
+
+	if t.IsZero() {
+		if closed {
+			d.expired = make(chan struct{})
+		}
+		return
+	}
+	if dur := time.Until(t); dur > 0 {
+		if closed {
+			d.expired = make(chan struct{})
+		}
+		ch := d.expired
+		d.timer = time.AfterFunc(dur, func() {
+			close(ch)
+		})
+		return
+	}
+	if !closed {
+		close(d.expired)
+	}
+}
+
+func (d *deadline) wait() <-chan struct{} {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.expired
+}
+
+// SetDeadline sets the read and write deadlines, see net.Conn.
+func (c *Connection) SetDeadline(t time.Time) error {
+	c.rd.set(t)
+	c.wd.set(t)
+	return nil
+}
+
+// SetReadDeadline sets the deadline of Read calls, see net.Conn.
+func (c *Connection) SetReadDeadline(t time.Time) error {
+	c.rd.set(t)
+	return nil
+}
+
+// SetWriteDeadline sets the deadline of Write calls, see net.Conn.
+func (c *Connection) SetWriteDeadline(t time.Time) error {
+	c.wd.set(t)
+	return nil
+}
+
+// timeout returns the error of an operation whose deadline expired, it
+// reports Timeout() true.
+func (c *Connection) timeout(op string) error {
+	return deadlineExceeded(op, "tcp", c.LocalAddr(), c.RemoteAddr())
+}
+
+func deadlineExceeded(op, network string, source, addr net.Addr) error {
+	return &net.OpError{
+		Op:     op,
+		Net:    network,
+		Source: source,
+		Addr:   addr,
+		Err:    os.ErrDeadlineExceeded,
+	}
+}
@@ -0,0 +1,106 @@
+package netcore
+
+import (
+	"errors"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestDeadline(t *testing.T) {
+	d := newDeadline()
+	d.set(time.Now().Add(20 * time.Millisecond))
+	select {
+	case <-d.wait():
+	case <-time.After(time.Second):
+		t.Fatal("deadline did not expire")
+	}
+
+	// moving the deadline into the future rearms it
+	d.set(time.Now().Add(time.Hour))
+	select {
+	case <-d.wait():
+		t.Fatal("deadline expired early")
+	default:
+	}
+
+	d.set(time.Now().Add(-time.Second))
+	select {
+	case <-d.wait():
+	default:
+		t.Fatal("a past deadline must be expired")
+	}
+
+	d.set(time.Time{})
+	select {
+	case <-d.wait():
+		t.Fatal("a zero deadline never expires")
+	default:
+	}
+}
+
+func TestReadDeadline(t *testing.T) {
+	s, ep := newTestStack(t)
+	defer ep.Close()
+
+	p := newPeer(t, ep, 1000)
+	p.handshake()
+	c, err := s.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	buf := make([]byte, 16)
+	_, err = c.Read(buf)
+	var ne net.Error
+	if !errors.As(err, &ne) || !ne.Timeout() || !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatal("expected a timeout", err)
+	}
+
+	c.SetReadDeadline(time.Time{})
+	data := p.segment()
+	data.ACK = true
+	data.Payload = []byte("hello")
+	p.send(data)
+	n, err := c.Read(buf)
+	if err != nil || string(buf[:n]) != "hello" {
+		t.Fatal("unexpected read", string(buf[:n]), err)
+	}
+}
+
+func TestClosedErrors(t *testing.T) {
+	s, ep := newTestStack(t)
+	defer ep.Close()
+
+	p := newPeer(t, ep, 1000)
+	p.handshake()
+	c, err := s.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	read := make(chan error, 1)
+	go func() {
+		_, err := c.Read(make([]byte, 16))
+		read <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+	if err = c.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	closed := func(what string, err error) {
+		var opErr *net.OpError
+		if !errors.As(err, &opErr) || !errors.Is(err, net.ErrClosed) {
+			t.Fatal("expected net.ErrClosed from", what, err)
+		}
+	}
+	closed("a blocked read", <-read)
+	_, err = c.Read(make([]byte, 16))
+	closed("read", err)
+	_, err = c.Write([]byte("late"))
+	closed("write", err)
+	closed("a second close", c.Close())
+}
@@ -0,0 +1,105 @@
+package netcore
+
+import (
+	"time"
+)
+
+const (
+	// DefaultDelayedACK is how long an ack for in-order data may be held
+	// back waiting for a segment to piggyback on (RFC 1122 section
+	// 4.2.3.2 allows up to 500ms).
+	DefaultDelayedACK = 40 * time.Millisecond
+)
+
+// SetDelayedACK sets how long new connections hold back an ack for in-order
+// data, zero acknowledges every segment at once.
+func (s *Stack) SetDelayedACK(d time.Duration) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if d < 0 {
+		d = 0
+	}
+	s.ackDelay = d
+}
+
+// SetACKOnPush makes new connections acknowledge segments carrying PSH at
+// once.
+func (s *Stack) SetACKOnPush(enabled bool) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.ackOnPush = enabled
+}
+
+// ackConfig copies the ack settings of the stack into a new connection.
+func (s *Stack) ackConfig(state *State) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	state.ackDelay = s.ackDelay
+	state.ackOnPush = s.ackOnPush
+}
+
+// measureSegment grows the estimate of the peer's full segment size to a
+// payload of n bytes, bounded by the MSS we advertised. It starts at the
+// smaller of the peer's MSS and DefaultMSS, so a peer sending segments
+// below its MSS still gets every second segment acked. The caller must
+// hold the state lock.
+func (c *Connection) measureSegment(n int) {
+	state := c.current
+	if n > state.inMSS {
+		state.inMSS = n
+	}
+	if state.inMSS > state.rcvMSS {
+		state.inMSS = state.rcvMSS
+	}
+}
+
+// scheduleACK acknowledges n bytes of in-order data. The ack goes out at
+// once for every second full-sized segment, for PSH when configured or
+// without an ack delay, otherwise after the delay unless a segment carries
+// it first. The caller must hold the state lock.
+func (c *Connection) scheduleACK(n int, psh bool) {
+	state := c.current
+	state.ackPending += n
+	if state.ackDelay == 0 || state.ackPending >= 2*state.inMSS || (psh && state.ackOnPush) {
+		r := ack(state)
+		c.Stack.SendTo(packtcp(r))
+		return
+	}
+	if state.ackTimer != nil {
+		return
+	}
+	state.ackGen++
+	gen := state.ackGen
+	state.ackTimer = time.AfterFunc(state.ackDelay, func() {
+		c.delayedACKTimeout(gen)
+	})
+}
+
+// stopDelayedACK stops the delayed ack timer. The caller must hold the
+// state lock.
+func (c *Connection) stopDelayedACK() {
+	state := c.current
+	if state.ackTimer != nil {
+		state.ackTimer.Stop()
+		state.ackTimer = nil
+	}
+	state.ackGen++
+}
+
+// delayedACKTimeout sends the held back ack unless another segment carried
+// it meanwhile.
+func (c *Connection) delayedACKTimeout(gen int) {
+	state := c.current
+	state.lockObject.Lock()
+	defer state.lockObject.Unlock()
+
+	if gen != state.ackGen {
+		return
+	}
+	state.ackTimer = nil
+	if c.closed || state.ackPending == 0 {
+		return
+	}
+	r := ack(state)
+	c.Stack.SendTo(packtcp(r))
+}
@@ -0,0 +1,93 @@
+package netcore
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Evan2698/netstackm/tcp"
+)
+
+func TestDelayedACK(t *testing.T) {
+	s, ep := newTestStack(t)
+	defer ep.Close()
+	s.SetDelayedACK(100 * time.Millisecond)
+
+	p := newPeer(t, ep, 1000)
+	p.handshake()
+	if _, err := s.Accept(); err != nil {
+		t.Fatal(err)
+	}
+
+	small := p.segment()
+	small.ACK = true
+	small.Payload = []byte("x")
+	p.send(small)
+	p.seq++
+	start := time.Now()
+	if a := p.recv(); a.Acknowledgment != p.seq || time.Since(start) < 50*time.Millisecond {
+		t.Fatal("expected a delayed ack", a.Acknowledgment, time.Since(start))
+	}
+
+	// every second full-sized segment is acknowledged at once
+	for i := 0; i < 2; i++ {
+		full := p.segment()
+		full.ACK = true
+		full.Payload = make([]byte, 1460)
+		p.send(full)
+		p.seq += 1460
+	}
+	start = time.Now()
+	if a := p.recv(); a.Acknowledgment != p.seq || time.Since(start) > 50*time.Millisecond {
+		t.Fatal("expected an immediate ack", a.Acknowledgment, time.Since(start))
+	}
+}
+
+func TestACKOnPush(t *testing.T) {
+	s, ep := newTestStack(t)
+	defer ep.Close()
+	s.SetDelayedACK(time.Second)
+	s.SetACKOnPush(true)
+
+	p := newPeer(t, ep, 1000)
+	p.handshake()
+	if _, err := s.Accept(); err != nil {
+		t.Fatal(err)
+	}
+
+	push := p.segment()
+	push.ACK = true
+	push.PSH = true
+	push.Payload = []byte("x")
+	p.send(push)
+	p.seq++
+	start := time.Now()
+	if a := p.recv(); a.Acknowledgment != p.seq || time.Since(start) > 500*time.Millisecond {
+		t.Fatal("expected an immediate ack", a.Acknowledgment, time.Since(start))
+	}
+}
+
+func TestDelayedACKSmallSegments(t *testing.T) {
+	s, ep := newTestStack(t)
+	defer ep.Close()
+	s.SetDelayedACK(time.Second)
+
+	p := newPeer(t, ep, 1000)
+	p.synOptions = []*tcp.TCPOption{tcp.NewMSSOption(1000)}
+	p.handshake()
+	if _, err := s.Accept(); err != nil {
+		t.Fatal(err)
+	}
+
+	// full-sized for this peer, though below the MSS we advertise
+	for i := 0; i < 2; i++ {
+		full := p.segment()
+		full.ACK = true
+		full.Payload = make([]byte, 1000)
+		p.send(full)
+		p.seq += 1000
+	}
+	start := time.Now()
+	if a := p.recv(); a.Acknowledgment != p.seq || time.Since(start) > 500*time.Millisecond {
+		t.Fatal("expected an immediate ack", a.Acknowledgment, time.Since(start))
+	}
+}
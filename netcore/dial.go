@@ -0,0 +1,158 @@
+package netcore
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/Evan2698/chimney/utils"
+	"github.com/Evan2698/netstackm/common"
+	"github.com/Evan2698/netstackm/tcp"
+)
+
+const (
+	ephemeralFirst = 49152
+	ephemeralLast  = 65535
+)
+
+// ErrConnectionRefused is returned by DialTCP when the host answers the SYN
+// with a RST.
+var ErrConnectionRefused = os.NewSyscallError("tcp", syscall.ECONNREFUSED)
+
+// DialTCP opens a connection to raddr, a host behind the tun, speaking as
+// laddr. A zero port in laddr picks an ephemeral port. It returns once the
+// handshake is done, the host refused the connection, the SYN timed out or
+// ctx is done.
+func (s *Stack) DialTCP(ctx context.Context, laddr, raddr *net.TCPAddr) (*Connection, error) {
+	if raddr == nil || raddr.IP.To4() == nil {
+		return nil, errors.New("remote address must be ipv4")
+	}
+	if laddr == nil || laddr.IP.To4() == nil {
+		return nil, errors.New("local address must be ipv4")
+	}
+	if s.stopping() {
+		return nil, errors.New("stack is shut down")
+	}
+
+	c := NewConnection(raddr.IP.To4(), laddr.IP.To4(), uint16(raddr.Port), uint16(laddr.Port), s)
+	c.active = true
+	c.established = make(chan struct{})
+	if err := c.connect(); err != nil {
+		return nil, err
+	}
+
+	select {
+	case <-c.established:
+		return c, nil
+	case <-c.done:
+		return nil, c.err
+	case <-ctx.Done():
+		c.current.lockObject.Lock()
+		c.abort(ctx.Err())
+		c.current.lockObject.Unlock()
+		return nil, ctx.Err()
+	case <-s.quit:
+		c.current.lockObject.Lock()
+		c.abort(errors.New("stack shut down"))
+		c.current.lockObject.Unlock()
+		return nil, errors.New("stack is shut down")
+	}
+}
+
+// connect registers the flow and sends the SYN.
+func (c *Connection) connect() error {
+	iss := c.Stack.newISS()
+	state := &State{
+		SrcIP:   c.Src,
+		SrcPort: c.SourcePort,
+		DestIP:  c.Dst,
+
+		Last:               time.Now(),
+		SendNext:           iss,
+		SendUnAcknowledged: iss,
+		highSacked:         iss,
+		rto:                InitialRTO,
+		tsOffset:           c.Stack.random(),
+
+		SocketState: SocketSynSent,
+		Conn:        c,
+	}
+
+	state.lockObject.Lock()
+	defer state.lockObject.Unlock()
+	c.current = state
+	c.Stack.ackConfig(state)
+	if err := c.Stack.bindPort(state, c.DestinationPort); err != nil {
+		return err
+	}
+	c.DestinationPort = state.DestPort
+
+	c.setReceiveBuffer(c.Stack.receiveBufferSize())
+	c.offer()
+	// replaced once the SYN-ACK tells the segment size
+	state.cc = c.Stack.newCongestionControl(state.sendMSS)
+	c.sendSegment(&segment{seq: iss, syn: true})
+	state.SendNext = iss.add(1)
+	return nil
+}
+
+// bindPort adds state to the table with port as the local port, a zero
+// port picks a free ephemeral one.
+func (s *Stack) bindPort(state *State, port uint16) error {
+	if port != 0 {
+		state.DestPort = port
+		if !s.t.AddUnique(state.SrcIP, state.DestIP, state.SrcPort, port, state) {
+			return syscall.EADDRINUSE
+		}
+		return nil
+	}
+
+	n := uint32(ephemeralLast - ephemeralFirst + 1)
+	start := s.random() % n
+	for i := uint32(0); i < n; i++ {
+		state.DestPort = uint16(ephemeralFirst + (start+i)%n)
+		if s.t.AddUnique(state.SrcIP, state.DestIP, state.SrcPort, state.DestPort, state) {
+			return nil
+		}
+	}
+	return errors.New("no ephemeral port available")
+}
+
+// handleSynSent waits for the SYN-ACK of an active open (RFC 793 section
+// 3.9). A simultaneous open is not supported, a bare SYN is dropped.
+func (c *Connection) handleSynSent(t *tcp.TCP) {
+	state := c.current
+	if t.ACK && seqnum(t.Acknowledgment) != state.SendNext {
+		if !t.RST {
+			c.Stack.refuse(t)
+		}
+		return
+	}
+	if t.RST {
+		if t.ACK {
+			utils.LOG.Println(common.GenerateUniqueKey(c.Src, c.Dst, c.SourcePort, c.DestinationPort),
+				"connection refused")
+			c.terminate(ErrConnectionRefused)
+		}
+		return
+	}
+	if !t.SYN || !t.ACK {
+		return
+	}
+
+	state.RecvNext = seqnum(t.Sequence).add(1)
+	state.sendWindow = uint32(t.WndSize)
+	state.sndWl1 = seqnum(t.Sequence)
+	state.sndWl2 = seqnum(t.Acknowledgment)
+	c.negotiate(t)
+	state.cc = c.Stack.newCongestionControl(state.sendMSS)
+	c.processAck(t, state.sendWindow)
+
+	state.SocketState = SocketEstablished
+	r := ack(state)
+	c.Stack.SendTo(packtcp(r))
+	close(c.established)
+}
@@ -0,0 +1,107 @@
+package netcore
+
+import (
+	"context"
+	"errors"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/Evan2698/netstackm/tcp"
+)
+
+type dialResult struct {
+	c   *Connection
+	err error
+}
+
+func dial(s *Stack, p *peer, lport int) chan dialResult {
+	ch := make(chan dialResult, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		c, err := s.DialTCP(ctx,
+			&net.TCPAddr{IP: p.dst, Port: lport},
+			&net.TCPAddr{IP: p.src, Port: int(p.sport)})
+		ch <- dialResult{c, err}
+	}()
+	return ch
+}
+
+func TestDialTCP(t *testing.T) {
+	s, ep := newTestStack(t)
+	defer ep.Close()
+
+	p := newPeer(t, ep, 5000)
+	ch := dial(s, p, 0)
+
+	syn := p.recv()
+	if !syn.SYN || syn.ACK || syn.SrcPort < ephemeralFirst {
+		t.Fatal("unexpected syn", syn.SYN, syn.ACK, syn.SrcPort)
+	}
+	if mss, ok := syn.MSS(); !ok || mss != 1460 {
+		t.Fatal("unexpected mss", mss, ok)
+	}
+	p.dport = syn.SrcPort
+	p.ack = syn.Sequence + 1
+
+	synack := p.segment()
+	synack.SYN = true
+	synack.ACK = true
+	synack.Options = []*tcp.TCPOption{tcp.NewMSSOption(1000)}
+	p.send(synack)
+	p.seq++
+
+	if ack := p.recv(); !ack.ACK || ack.SYN || ack.Acknowledgment != p.seq {
+		t.Fatal("expected the ack of the handshake", ack.Acknowledgment)
+	}
+	r := <-ch
+	if r.err != nil {
+		t.Fatal(r.err)
+	}
+	c := r.c
+	if ra := c.RemoteAddr().(*net.TCPAddr); !ra.IP.Equal(p.src) || ra.Port != int(p.sport) {
+		t.Fatal("unexpected remote address", ra)
+	}
+
+	// only options confirmed by the SYN-ACK are used
+	if _, err := c.Write(make([]byte, 1500)); err != nil {
+		t.Fatal(err)
+	}
+	out := p.recvData()
+	if len(out.Payload) != 1000 || len(out.Options) != 0 {
+		t.Fatal("unexpected segment", len(out.Payload), len(out.Options))
+	}
+}
+
+func TestDialRefused(t *testing.T) {
+	s, ep := newTestStack(t)
+	defer ep.Close()
+
+	p := newPeer(t, ep, 5000)
+	ch := dial(s, p, 8080)
+
+	syn := p.recv()
+	if syn.SrcPort != 8080 {
+		t.Fatal("unexpected port", syn.SrcPort)
+	}
+	p.dport = syn.SrcPort
+	p.ack = syn.Sequence + 1
+
+	refuse := p.segment()
+	refuse.RST = true
+	refuse.ACK = true
+	p.send(refuse)
+
+	r := <-ch
+	if !errors.Is(r.err, syscall.ECONNREFUSED) {
+		t.Fatal("expected ECONNREFUSED", r.err)
+	}
+
+	// the port is free again
+	ch = dial(s, p, 8080)
+	if syn = p.recv(); !syn.SYN || syn.SrcPort != 8080 {
+		t.Fatal("expected a new syn")
+	}
+}
@@ -0,0 +1,108 @@
+package netcore
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+	"runtime"
+	"sync"
+	"sync/atomic"
+
+	"github.com/Evan2698/chimney/utils"
+	"github.com/Evan2698/netstackm/ipv4"
+)
+
+const (
+	// DefaultDispatchQueueDepth is the default queue length of one worker.
+	DefaultDispatchQueueDepth = 256
+)
+
+// dispatcher hands ingress packets to a fixed set of workers. Packets of the
+// same flow always land on the same worker, so they are handled in order.
+type dispatcher struct {
+	queues  []chan []byte
+	handle  func([]byte)
+	dropped []uint64
+	wg      sync.WaitGroup
+}
+
+func newDispatcher(workers, depth int, handle func([]byte)) *dispatcher {
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	if depth <= 0 {
+		depth = DefaultDispatchQueueDepth
+	}
+
+	d := &dispatcher{
+		queues:  make([]chan []byte, workers),
+		handle:  handle,
+		dropped: make([]uint64, workers),
+	}
+	for i := range d.queues {
+		d.queues[i] = make(chan []byte, depth)
+	}
+	return d
+}
+
+func (d *dispatcher) start() {
+	for i := range d.queues {
+		d.wg.Add(1)
+		go d.work(d.queues[i])
+	}
+}
+
+func (d *dispatcher) work(q chan []byte) {
+	defer d.wg.Done()
+	for pkt := range q {
+		d.handle(pkt)
+	}
+}
+
+// dispatch queues one packet, it never blocks. When the queue of the flow is
+// full the packet is dropped and counted.
+func (d *dispatcher) dispatch(pkt []byte) {
+	i := d.worker(pkt)
+	select {
+	case d.queues[i] <- pkt:
+	default:
+		atomic.AddUint64(&d.dropped[i], 1)
+		utils.LOG.Println("ingress queue is full, drop packet on worker", i)
+	}
+}
+
+// stop closes all queues and waits for the workers to exit. It must be
+// called by the goroutine which calls dispatch.
+func (d *dispatcher) stop() {
+	for _, q := range d.queues {
+		close(q)
+	}
+	d.wg.Wait()
+}
+
+// worker hashes the flow 4-tuple of an ip packet to a worker index.
+func (d *dispatcher) worker(pkt []byte) int {
+	if len(d.queues) == 1 || len(pkt) < 20 {
+		return 0
+	}
+
+	h := fnv.New32a()
+	h.Write(pkt[9:10])  // protocol
+	h.Write(pkt[12:20]) // source and destination address
+
+	ihl := int(pkt[0]&0xf) * 4
+	fragment := binary.BigEndian.Uint16(pkt[6:8])&0x3fff != 0
+	proto := ipv4.IPProtocol(pkt[9])
+	if !fragment && (proto == ipv4.IPProtocolTCP || proto == ipv4.IPProtocolUDP) && len(pkt) >= ihl+4 {
+		h.Write(pkt[ihl : ihl+4]) // source and destination port
+	}
+
+	return int(h.Sum32() % uint32(len(d.queues)))
+}
+
+func (d *dispatcher) droppedPackets() uint64 {
+	var total uint64
+	for i := range d.dropped {
+		total += atomic.LoadUint64(&d.dropped[i])
+	}
+	return total
+}
@@ -0,0 +1,36 @@
+package netcore
+
+import (
+	"net"
+	"testing"
+
+	"github.com/Evan2698/netstackm/tcp"
+)
+
+func TestDispatcherFlowAffinity(t *testing.T) {
+	d := newDispatcher(8, 1, func([]byte) {})
+
+	flow := func(sport uint16, seq uint32) []byte {
+		pak := tcp.Newtcp()
+		pak.SrcIP = net.IPv4(10, 0, 0, 2).To4()
+		pak.DstIP = net.IPv4(1, 1, 1, 1).To4()
+		pak.SrcPort = sport
+		pak.DstPort = 443
+		pak.Sequence = seq
+		return packtcp(pak)
+	}
+
+	w := d.worker(flow(5000, 1))
+	for seq := uint32(2); seq < 100; seq++ {
+		if d.worker(flow(5000, seq)) != w {
+			t.Fatal("packets of one flow hashed to different workers")
+		}
+	}
+
+	// workers are not started, so the second packet overflows the queue
+	d.dispatch(flow(5000, 1))
+	d.dispatch(flow(5000, 2))
+	if d.droppedPackets() != 1 {
+		t.Fatal("expected one dropped packet, got", d.droppedPackets())
+	}
+}
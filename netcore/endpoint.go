@@ -0,0 +1,161 @@
+package netcore
+
+import (
+	"errors"
+	"os"
+	"sync"
+
+	"github.com/Evan2698/netstackm/common"
+)
+
+var (
+	// ErrEndpointClosed is returned by a LinkEndpoint after Close.
+	ErrEndpointClosed = errors.New("link endpoint closed")
+	// ErrPacketTooBig is returned by ReadPacket, with the full packet
+	// length, when the packet does not fit the buffer. The packet is
+	// dropped.
+	ErrPacketTooBig = errors.New("packet larger than read buffer")
+)
+
+// LinkEndpoint is the packet interface the Stack reads ip packets from and
+// writes ip packets to.
+type LinkEndpoint interface {
+	// ReadPacket reads one ip packet into b and returns its length.
+	ReadPacket(b []byte) (int, error)
+	// WritePacket writes one ip packet.
+	WritePacket(b []byte) error
+	// MTU returns the maximum ip packet size of the link.
+	MTU() int
+	// Close unblocks pending reads and releases the link.
+	Close() error
+}
+
+// FDEndpoint is a LinkEndpoint backed by a tun file descriptor.
+type FDEndpoint struct {
+	f   *os.File
+	mtu int
+}
+
+// NewFDEndpoint wraps a tun descriptor.
+func NewFDEndpoint(fd int, mtu int) *FDEndpoint {
+	if mtu <= 0 {
+		mtu = common.CONFIGMTU
+	}
+	return &FDEndpoint{
+		f:   os.NewFile(uintptr(fd), ""),
+		mtu: mtu,
+	}
+}
+
+// ReadPacket ...
+func (e *FDEndpoint) ReadPacket(b []byte) (int, error) {
+	return e.f.Read(b)
+}
+
+// WritePacket ...
+func (e *FDEndpoint) WritePacket(b []byte) error {
+	_, err := e.f.Write(b)
+	return err
+}
+
+// MTU ...
+func (e *FDEndpoint) MTU() int {
+	return e.mtu
+}
+
+// Close ...
+func (e *FDEndpoint) Close() error {
+	return e.f.Close()
+}
+
+// ChannelEndpoint is an in-memory LinkEndpoint. Packets passed to Inject are
+// read by the Stack, packets written by the Stack are delivered on Outbound.
+type ChannelEndpoint struct {
+	mtu int
+
+	inbound  chan []byte
+	outbound chan []byte
+
+	once sync.Once
+	done chan struct{}
+}
+
+// NewChannelEndpoint creates a channel endpoint, size is the queue length of
+// each direction.
+func NewChannelEndpoint(mtu int, size int) *ChannelEndpoint {
+	if mtu <= 0 {
+		mtu = common.CONFIGMTU
+	}
+	return &ChannelEndpoint{
+		mtu:      mtu,
+		inbound:  make(chan []byte, size),
+		outbound: make(chan []byte, size),
+		done:     make(chan struct{}),
+	}
+}
+
+// Inject queues one ip packet for the Stack to read.
+func (e *ChannelEndpoint) Inject(pkt []byte) error {
+	select {
+	case <-e.done:
+		return ErrEndpointClosed
+	default:
+	}
+
+	select {
+	case e.inbound <- pkt:
+		return nil
+	case <-e.done:
+		return ErrEndpointClosed
+	}
+}
+
+// Outbound returns the channel of packets written by the Stack.
+func (e *ChannelEndpoint) Outbound() <-chan []byte {
+	return e.outbound
+}
+
+// ReadPacket ...
+func (e *ChannelEndpoint) ReadPacket(b []byte) (int, error) {
+	select {
+	case pkt := <-e.inbound:
+		if len(pkt) > len(b) {
+			return len(pkt), ErrPacketTooBig
+		}
+		return copy(b, pkt), nil
+	case <-e.done:
+		return 0, ErrEndpointClosed
+	}
+}
+
+// WritePacket ...
+func (e *ChannelEndpoint) WritePacket(b []byte) error {
+	pkt := make([]byte, len(b))
+	copy(pkt, b)
+
+	select {
+	case <-e.done:
+		return ErrEndpointClosed
+	default:
+	}
+
+	select {
+	case e.outbound <- pkt:
+		return nil
+	case <-e.done:
+		return ErrEndpointClosed
+	}
+}
+
+// MTU ...
+func (e *ChannelEndpoint) MTU() int {
+	return e.mtu
+}
+
+// Close ...
+func (e *ChannelEndpoint) Close() error {
+	e.once.Do(func() {
+		close(e.done)
+	})
+	return nil
+}
@@ -0,0 +1,201 @@
+package netcore
+
+import (
+	"time"
+
+	"github.com/Evan2698/netstackm/tcp"
+)
+
+const (
+	// DefaultReceiveBufferSize is the size of the receive buffer of a
+	// connection, it bounds the window we advertise.
+	DefaultReceiveBufferSize = MAX_RECV_WINDOW
+
+	// MaxReceiveBufferSize is the largest window window scaling can offer.
+	MaxReceiveBufferSize = 0xffff << maxWindowShift
+
+	maxWindowShift = 14
+)
+
+// SetReceiveBufferSize sets the receive buffer size of new connections.
+// Sizes above 64 KB take effect when the peer negotiates window scaling.
+func (s *Stack) SetReceiveBufferSize(n int) {
+	if n > MaxReceiveBufferSize {
+		n = MaxReceiveBufferSize
+	}
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.rcvBufSize = n
+}
+
+func (s *Stack) receiveBufferSize() int {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if s.rcvBufSize <= 0 {
+		return DefaultReceiveBufferSize
+	}
+	return s.rcvBufSize
+}
+
+// setReceiveBuffer sizes the receive buffer and the out-of-order queue. The
+// caller must hold the state lock.
+func (c *Connection) setReceiveBuffer(n int) {
+	state := c.current
+	state.rcvBufSize = n
+	if state.ooo == nil {
+		state.ooo = newReassembler(n)
+	}
+	state.ooo.limit = n
+	c.updateRecvWindow()
+}
+
+// updateWindow takes the peer's receive window from t when t is newer than
+// the segment which last updated it (RFC 793 SND.WL1/SND.WL2). The caller
+// must hold the state lock.
+func (c *Connection) updateWindow(t *tcp.TCP) {
+	state := c.current
+	if !t.ACK || t.RST {
+		return
+	}
+	seq, ack := seqnum(t.Sequence), seqnum(t.Acknowledgment)
+	if seq.lessThan(state.sndWl1) || (seq == state.sndWl1 && ack.lessThan(state.sndWl2)) {
+		return
+	}
+
+	old := state.sendWindow
+	state.sendWindow = uint32(t.WndSize)
+	// the window of a SYN segment is never scaled
+	if !t.SYN {
+		state.sendWindow <<= state.sndWndShift
+	}
+	state.sndWl1 = seq
+	state.sndWl2 = ack
+
+	if state.sendWindow > 0 {
+		c.stopPersist()
+	}
+	if state.sendWindow > old {
+		c.notifyWritable()
+	}
+}
+
+// inFlight returns the number of sent but unacknowledged bytes.
+func (c *Connection) inFlight() uint32 {
+	state := c.current
+	return state.SendUnAcknowledged.size(state.SendNext)
+}
+
+// usableWindow returns how many bytes the peer's window and the congestion
+// window allow to send right now. The caller must hold the state lock.
+func (c *Connection) usableWindow() int {
+	state := c.current
+	used := c.inFlight()
+	if used >= state.sendWindow {
+		return 0
+	}
+	usable := state.sendWindow - used
+
+	cwnd := uint32(state.cc.Window())
+	pipe := c.pipe()
+	if pipe >= cwnd {
+		return 0
+	}
+	if cwnd-pipe < usable {
+		usable = cwnd - pipe
+	}
+	return int(usable)
+}
+
+// notifyWritable wakes a Write blocked on the send window.
+func (c *Connection) notifyWritable() {
+	select {
+	case c.writable <- true:
+	default:
+	}
+}
+
+// armPersist starts the persist timer which probes a zero window. The
+// caller must hold the state lock.
+func (c *Connection) armPersist() {
+	state := c.current
+	if state.persistTimer != nil {
+		return
+	}
+	if state.persistBackoff == 0 {
+		state.persistBackoff = state.rto
+	}
+	state.persistGen++
+	gen := state.persistGen
+	state.persistTimer = time.AfterFunc(state.persistBackoff, func() {
+		c.persistTimeout(gen)
+	})
+}
+
+// stopPersist stops the persist timer. The caller must hold the state lock.
+func (c *Connection) stopPersist() {
+	state := c.current
+	if state.persistTimer != nil {
+		state.persistTimer.Stop()
+		state.persistTimer = nil
+	}
+	state.persistGen++
+	state.persistBackoff = 0
+}
+
+// persistTimeout sends a window probe, the peer answers it with an ack
+// carrying its current window.
+func (c *Connection) persistTimeout(gen int) {
+	state := c.current
+	state.lockObject.Lock()
+	defer state.lockObject.Unlock()
+
+	if gen != state.persistGen {
+		return
+	}
+	state.persistTimer = nil
+	if c.closed || state.sendWindow > 0 {
+		state.persistBackoff = 0
+		return
+	}
+
+	r := probe(state)
+	c.Stack.SendTo(packtcp(r))
+
+	state.persistBackoff *= 2
+	if state.persistBackoff > MaxRTO {
+		state.persistBackoff = MaxRTO
+	}
+	c.armPersist()
+}
+
+// updateRecvWindow sets the receive window to the free space of the receive
+// buffer. The caller must hold the state lock.
+func (c *Connection) updateRecvWindow() {
+	state := c.current
+	free := state.rcvBufSize - len(c.buffer)
+	if free < 0 {
+		free = 0
+	}
+	state.recvWindow = uint32(free)
+}
+
+// windowUpdate sends an ack when reading data opened the window by at least
+// one segment or half the buffer (RFC 1122 receiver SWS avoidance). The
+// caller must hold the state lock.
+func (c *Connection) windowUpdate() {
+	state := c.current
+	c.updateRecvWindow()
+
+	threshold := uint32(state.rcvMSS)
+	if half := uint32(state.rcvBufSize / 2); half < threshold {
+		threshold = half
+	}
+	if state.recvWindow < state.advertised+threshold {
+		return
+	}
+	switch state.SocketState {
+	case SocketEstablished, SocketFinWait1, SocketFinWait2:
+		r := ack(state)
+		c.Stack.SendTo(packtcp(r))
+	}
+}
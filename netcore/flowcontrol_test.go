@@ -0,0 +1,92 @@
+package netcore
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Evan2698/netstackm/tcp"
+)
+
+// fillReceiveBuffer sends full segments until the 4000 byte receive buffer
+// of the connection is full.
+func fillReceiveBuffer(t *testing.T, p *peer) {
+	for want := 3000; want >= 0; want -= 1000 {
+		data := p.segment()
+		data.ACK = true
+		data.Payload = make([]byte, 1000)
+		p.send(data)
+		p.seq += 1000
+		a := p.recv()
+		if a.Acknowledgment != p.seq || int(a.WndSize) != want {
+			t.Fatal("unexpected ack", a.Acknowledgment, p.seq, a.WndSize, want)
+		}
+	}
+}
+
+func TestReceiveWindowShrinks(t *testing.T) {
+	s, ep := newTestStack(t)
+	defer ep.Close()
+	s.SetReceiveBufferSize(4000)
+	s.SetDelayedACK(0)
+
+	p := newPeer(t, ep, 1000)
+	p.synOptions = []*tcp.TCPOption{tcp.NewMSSOption(1000)}
+	p.handshake()
+	if _, err := s.Accept(); err != nil {
+		t.Fatal(err)
+	}
+	fillReceiveBuffer(t, p)
+
+	// data beyond the closed window is not acknowledged
+	excess := p.segment()
+	excess.ACK = true
+	excess.Payload = make([]byte, 1000)
+	p.send(excess)
+	if a := p.recv(); a.Acknowledgment != p.seq || a.WndSize != 0 {
+		t.Fatal("excess data was taken", a.Acknowledgment, p.seq, a.WndSize)
+	}
+}
+
+func TestWindowUpdate(t *testing.T) {
+	s, ep := newTestStack(t)
+	defer ep.Close()
+	s.SetReceiveBufferSize(4000)
+	s.SetDelayedACK(0)
+
+	p := newPeer(t, ep, 1000)
+	p.synOptions = []*tcp.TCPOption{tcp.NewMSSOption(1000)}
+	p.handshake()
+	c, err := s.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fillReceiveBuffer(t, p)
+
+	noUpdate := func() {
+		select {
+		case b := <-ep.Outbound():
+			t.Fatal("unexpected window update", len(b))
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+	buf := make([]byte, 1000)
+
+	// an opening smaller than the MSS (1460) is not announced
+	if _, err = c.Read(buf); err != nil {
+		t.Fatal(err)
+	}
+	noUpdate()
+
+	if _, err = c.Read(buf); err != nil {
+		t.Fatal(err)
+	}
+	if a := p.recv(); a.Acknowledgment != p.seq || a.WndSize != 2000 {
+		t.Fatal("expected a window update", a.Acknowledgment, a.WndSize)
+	}
+	noUpdate()
+
+	if _, err = c.Read(buf[:500]); err != nil {
+		t.Fatal(err)
+	}
+	noUpdate()
+}
@@ -7,6 +7,30 @@ import (
 	"github.com/Evan2698/netstackm/tcp"
 )
 
+// window returns the scaled receive window to advertise and remembers it.
+// The segment carrying it acknowledges everything received, so no ack is
+// pending any more.
+func window(current *State) uint16 {
+	current.ackPending = 0
+	w := current.recvWindow >> current.rcvWndShift
+	if w > 0xffff {
+		w = 0xffff
+	}
+	current.advertised = w << current.rcvWndShift
+	return uint16(w)
+}
+
+// synWindow returns the receive window of a SYN segment, which is never
+// scaled.
+func synWindow(current *State) uint16 {
+	w := current.recvWindow
+	if w > 0xffff {
+		w = 0xffff
+	}
+	current.advertised = w
+	return uint16(w)
+}
+
 func synack(c *State) *tcp.TCP {
 	pak := tcp.Newtcp()
 	pak.SrcIP = c.DestIP
@@ -15,16 +39,25 @@ func synack(c *State) *tcp.TCP {
 	pak.DstPort = c.SrcPort
 	pak.SYN = true
 	pak.ACK = true
-	pak.Sequence = c.SendNext
-	pak.Acknowledgment = c.RecvNext
-	pak.WndSize = 64420
-	pak.Options = make([]*tcp.TCPOption, 1)
+	pak.Sequence = uint32(c.SendNext)
+	pak.Acknowledgment = uint32(c.RecvNext)
+	pak.WndSize = synWindow(c)
+	pak.Options = synOptions(c)
+
+	return pak
+}
 
-	item := tcp.NewTCPOption()
-	item.Type = 2
-	item.Length = 4
-	item.Data = []byte{0x5, 0xb4}
-	pak.Options[0] = item
+// syn builds the SYN of an active open.
+func syn(c *State) *tcp.TCP {
+	pak := tcp.Newtcp()
+	pak.SrcIP = c.DestIP
+	pak.DstIP = c.SrcIP
+	pak.SrcPort = c.DestPort
+	pak.DstPort = c.SrcPort
+	pak.SYN = true
+	pak.Sequence = uint32(c.SendNext)
+	pak.WndSize = synWindow(c)
+	pak.Options = synOptions(c)
 
 	return pak
 }
@@ -49,6 +82,20 @@ func rst(sip, dip net.IP, sport, dport uint16, seq, ack uint32, payloadlen uint3
 	return pak
 }
 
+// reset builds a RST for an existing connection.
+func reset(current *State) *tcp.TCP {
+	pak := tcp.Newtcp()
+	pak.SrcIP = current.DestIP
+	pak.DstIP = current.SrcIP
+	pak.SrcPort = current.DestPort
+	pak.DstPort = current.SrcPort
+	pak.RST = true
+	pak.ACK = true
+	pak.Sequence = uint32(current.SendNext)
+	pak.Acknowledgment = uint32(current.RecvNext)
+	return pak
+}
+
 func packtcp(tcp *tcp.TCP) []byte {
 	ip := ipv4.NewIPv4()
 	ip.Version = 4
@@ -64,16 +111,6 @@ func packtcp(tcp *tcp.TCP) []byte {
 	return ip.ToBytes()
 }
 
-func validAck(ack, nextseq uint32) bool {
-	ret := (ack == nextseq)
-	return ret
-}
-
-func validSeq(seq, nextseq uint32) bool {
-	ret := (seq == nextseq)
-	return ret
-}
-
 func ack(current *State) *tcp.TCP {
 
 	pak := tcp.Newtcp()
@@ -81,11 +118,20 @@ func ack(current *State) *tcp.TCP {
 	pak.DstIP = current.SrcIP
 	pak.SrcPort = current.DestPort
 	pak.DstPort = current.SrcPort
-	pak.WndSize = 64420
+	pak.WndSize = window(current)
 	pak.ACK = true
-	pak.Sequence = current.SendNext
-	pak.Acknowledgment = current.RecvNext
+	pak.Sequence = uint32(current.SendNext)
+	pak.Acknowledgment = uint32(current.RecvNext)
+	pak.Options = segmentOptions(current, true)
+
+	return pak
+}
 
+// probe builds a zero-length segment with an old sequence number, the peer
+// answers it with an ack carrying its current window.
+func probe(current *State) *tcp.TCP {
+	pak := ack(current)
+	pak.Sequence = uint32(current.SendUnAcknowledged - 1)
 	return pak
 }
 
@@ -95,11 +141,12 @@ func finAck(current *State) *tcp.TCP {
 	pak.DstIP = current.SrcIP
 	pak.SrcPort = current.DestPort
 	pak.DstPort = current.SrcPort
-	pak.WndSize = 64420
+	pak.WndSize = window(current)
 	pak.FIN = true
 	pak.ACK = true
-	pak.Sequence = current.SendNext
-	pak.Acknowledgment = current.RecvNext
+	pak.Sequence = uint32(current.SendNext)
+	pak.Acknowledgment = uint32(current.RecvNext)
+	pak.Options = segmentOptions(current, false)
 	return pak
 }
 
@@ -110,11 +157,12 @@ func payload(current *State, data []byte) *tcp.TCP {
 	pak.DstIP = current.SrcIP
 	pak.SrcPort = current.DestPort
 	pak.DstPort = current.SrcPort
-	pak.WndSize = 64420
+	pak.WndSize = window(current)
 	pak.ACK = true
 	pak.PSH = true
-	pak.Sequence = current.SendNext
-	pak.Acknowledgment = current.RecvNext
+	pak.Sequence = uint32(current.SendNext)
+	pak.Acknowledgment = uint32(current.RecvNext)
 	pak.Payload = data
+	pak.Options = segmentOptions(current, false)
 	return pak
 }
@@ -0,0 +1,183 @@
+package netcore
+
+import (
+	"errors"
+	"syscall"
+	"time"
+
+	"github.com/Evan2698/chimney/utils"
+	"github.com/Evan2698/netstackm/common"
+)
+
+const (
+	// DefaultKeepAlivePeriod is the idle time before the first keepalive
+	// probe and the interval between probes (RFC 1122 section 4.2.3.6).
+	DefaultKeepAlivePeriod = 2 * time.Hour
+	// KeepAliveProbes is the number of unanswered probes after which the
+	// connection is aborted.
+	KeepAliveProbes = 9
+
+	// maxIdleScan bounds the interval between two idle timeout scans.
+	maxIdleScan = 30 * time.Second
+)
+
+// SetKeepAlive enables or disables keepalive probes, see net.TCPConn.
+func (c *Connection) SetKeepAlive(keepalive bool) error {
+	state := c.current
+	state.lockObject.Lock()
+	defer state.lockObject.Unlock()
+	if c.closed {
+		return errors.New(SocketClosed.String())
+	}
+	state.keepAlive = keepalive
+	if keepalive {
+		c.armKeepAlive(c.keepAlivePeriod())
+	} else {
+		c.stopKeepAlive()
+	}
+	return nil
+}
+
+// SetKeepAlivePeriod sets the idle time before the first probe and the
+// interval between probes, see net.TCPConn.
+func (c *Connection) SetKeepAlivePeriod(d time.Duration) error {
+	if d <= 0 {
+		return errors.New("invalid keepalive period")
+	}
+	state := c.current
+	state.lockObject.Lock()
+	defer state.lockObject.Unlock()
+	if c.closed {
+		return errors.New(SocketClosed.String())
+	}
+	state.keepAlivePeriod = d
+	if state.keepAlive {
+		c.armKeepAlive(d)
+	}
+	return nil
+}
+
+func (c *Connection) keepAlivePeriod() time.Duration {
+	if c.current.keepAlivePeriod == 0 {
+		return DefaultKeepAlivePeriod
+	}
+	return c.current.keepAlivePeriod
+}
+
+// armKeepAlive (re)starts the keepalive timer. The caller must hold the
+// state lock.
+func (c *Connection) armKeepAlive(d time.Duration) {
+	state := c.current
+	if state.keepAliveTimer != nil {
+		state.keepAliveTimer.Stop()
+	}
+	state.keepAliveGen++
+	gen := state.keepAliveGen
+	state.keepAliveTimer = time.AfterFunc(d, func() {
+		c.keepAliveTimeout(gen)
+	})
+}
+
+// stopKeepAlive stops the keepalive timer. The caller must hold the state
+// lock.
+func (c *Connection) stopKeepAlive() {
+	state := c.current
+	if state.keepAliveTimer != nil {
+		state.keepAliveTimer.Stop()
+		state.keepAliveTimer = nil
+	}
+	state.keepAliveGen++
+	state.keepAliveProbes = 0
+}
+
+// keepAliveTimeout sends a probe once the connection was idle for the
+// keepalive period and aborts it after KeepAliveProbes unanswered probes.
+// Any inbound segment counts as an answer.
+func (c *Connection) keepAliveTimeout(gen int) {
+	state := c.current
+	state.lockObject.Lock()
+	defer state.lockObject.Unlock()
+
+	if gen != state.keepAliveGen {
+		return
+	}
+	state.keepAliveTimer = nil
+	if c.closed || !state.keepAlive {
+		return
+	}
+
+	period := c.keepAlivePeriod()
+	if idle := time.Since(state.Last); state.keepAliveProbes == 0 && idle < period {
+		c.armKeepAlive(period - idle)
+		return
+	}
+	if state.keepAliveProbes >= KeepAliveProbes {
+		utils.LOG.Println(common.GenerateUniqueKey(c.Src, c.Dst, c.SourcePort, c.DestinationPort),
+			"keepalive timed out, reset connection")
+		c.abort(syscall.ETIMEDOUT)
+		return
+	}
+
+	// unacknowledged data is probed by the retransmission timer
+	if len(state.unacked) == 0 {
+		r := probe(state)
+		c.Stack.SendTo(packtcp(r))
+		state.keepAliveProbes++
+	}
+	c.armKeepAlive(period)
+}
+
+// SetIdleTimeout aborts TCP connections and closes UDP sessions which
+// received nothing for d, zero disables the timeout.
+func (s *Stack) SetIdleTimeout(d time.Duration) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if s.janitor != nil {
+		close(s.janitor)
+		s.janitor = nil
+	}
+	if d <= 0 {
+		return
+	}
+	s.janitor = make(chan struct{})
+	go s.expireIdle(d, s.janitor)
+}
+
+// expireIdle scans the state tables for idle flows until stop is closed or
+// the stack shuts down.
+func (s *Stack) expireIdle(d time.Duration, stop chan struct{}) {
+	interval := d / 2
+	if interval > maxIdleScan {
+		interval = maxIdleScan
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-s.quit:
+			return
+		case <-ticker.C:
+		}
+
+		for _, state := range s.t.Snapshot() {
+			state.lockObject.Lock()
+			if c := state.Conn; c != nil && state.SocketState != SocketTimeWait && time.Since(state.Last) > d {
+				utils.LOG.Println(common.GenerateUniqueKey(c.Src, c.Dst, c.SourcePort, c.DestinationPort),
+					"idle timeout, reset connection")
+				c.abort(syscall.ETIMEDOUT)
+			}
+			state.lockObject.Unlock()
+		}
+		for _, state := range s.u.Snapshot() {
+			state.lockObject.Lock()
+			idle := time.Since(state.Last) > d
+			state.lockObject.Unlock()
+			if idle && state.Connu != nil {
+				state.Connu.Close()
+			}
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package netcore
+
+import (
+	"errors"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestKeepAlive(t *testing.T) {
+	s, ep := newTestStack(t)
+	defer ep.Close()
+
+	p := newPeer(t, ep, 1000)
+	p.handshake()
+	c, err := s.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.SetKeepAlivePeriod(50 * time.Millisecond)
+	c.SetKeepAlive(true)
+
+	probe := p.recv()
+	if probe.Sequence != p.ack-1 || len(probe.Payload) != 0 {
+		t.Fatal("expected a keepalive probe", probe.Sequence, p.ack)
+	}
+	answer := p.segment()
+	answer.ACK = true
+	p.send(answer)
+
+	// the peer is gone, the probes stay unanswered
+	read := make(chan error, 1)
+	go func() {
+		_, err := c.Read(make([]byte, 1))
+		read <- err
+	}()
+	select {
+	case err := <-read:
+		if !errors.Is(err, syscall.ETIMEDOUT) {
+			t.Fatal("expected ETIMEDOUT", err)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("keepalive did not abort the connection")
+	}
+}
+
+func TestIdleTimeout(t *testing.T) {
+	s, ep := newTestStack(t)
+	defer ep.Close()
+	s.SetIdleTimeout(100 * time.Millisecond)
+
+	p := newPeer(t, ep, 1000)
+	p.handshake()
+	c, err := s.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	_, err = c.Read(make([]byte, 1))
+	if !errors.Is(err, syscall.ETIMEDOUT) {
+		t.Fatal("expected ETIMEDOUT", err)
+	}
+	if time.Since(start) > time.Second {
+		t.Fatal("idle connection was expired late")
+	}
+}
@@ -0,0 +1,221 @@
+package netcore
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/Evan2698/chimney/utils"
+	"github.com/Evan2698/netstackm/common"
+)
+
+// DefaultBacklog is the number of established connections a Listener
+// queues before new ones are reset.
+const DefaultBacklog = 128
+
+// Listener receives the TCP flows whose destination matches its address,
+// see Stack.Listen.
+type Listener struct {
+	s      *Stack
+	prefix *net.IPNet
+	port   uint16
+
+	accept chan *Connection
+	done   chan struct{}
+	mu     sync.Mutex
+	closed bool
+}
+
+var _ net.Listener = (*Listener)(nil)
+
+// Listen returns a listener for the flows entering the tun toward addr.
+// network has to be "tcp" or "tcp4". addr is host:port where host is an
+// ipv4 address, a CIDR prefix or empty for any address, port 0 matches any
+// port. A flow goes to the listener with a specific port before one for any
+// port, and then to the longest prefix. Flows matching no listener go to
+// Accept or are reset, see SetDefaultAccept.
+func (s *Stack) Listen(network, addr string) (*Listener, error) {
+	if network != "tcp" && network != "tcp4" {
+		return nil, errors.New("unsupported network: " + network)
+	}
+	prefix, port, err := parseListenAddr(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	l := &Listener{
+		s:      s,
+		prefix: prefix,
+		port:   port,
+		accept: make(chan *Connection, DefaultBacklog),
+		done:   make(chan struct{}),
+	}
+
+	s.m.Lock()
+	defer s.m.Unlock()
+	for _, o := range s.listeners {
+		if o.port == l.port && o.prefix.String() == l.prefix.String() {
+			return nil, syscall.EADDRINUSE
+		}
+	}
+	s.listeners = append(s.listeners, l)
+	return l, nil
+}
+
+// parseListenAddr splits host:port into a prefix and a port.
+func parseListenAddr(addr string) (*net.IPNet, uint16, error) {
+	i := strings.LastIndex(addr, ":")
+	if i < 0 {
+		return nil, 0, errors.New("missing port in address: " + addr)
+	}
+	host := addr[:i]
+	port, err := strconv.ParseUint(addr[i+1:], 10, 16)
+	if err != nil {
+		return nil, 0, errors.New("invalid port in address: " + addr)
+	}
+
+	if !strings.Contains(host, "/") {
+		switch ip := net.ParseIP(host); {
+		case host == "" || (ip != nil && ip.IsUnspecified()):
+			host = "0.0.0.0/0"
+		default:
+			host += "/32"
+		}
+	}
+	_, prefix, err := net.ParseCIDR(host)
+	if err != nil || prefix.IP.To4() == nil {
+		return nil, 0, errors.New("invalid ipv4 address: " + addr)
+	}
+	return prefix, uint16(port), nil
+}
+
+// matches reports whether the listener takes flows toward ip and port.
+func (l *Listener) matches(ip net.IP, port uint16) bool {
+	return (l.port == 0 || l.port == port) && l.prefix.Contains(ip)
+}
+
+// specificity orders the listeners matching one flow.
+func (l *Listener) specificity() int {
+	ones, _ := l.prefix.Mask.Size()
+	if l.port != 0 {
+		ones += 64
+	}
+	return ones
+}
+
+// listenerFor returns the most specific listener for a flow toward ip and
+// port, nil if there is none.
+func (s *Stack) listenerFor(ip net.IP, port uint16) *Listener {
+	s.m.Lock()
+	defer s.m.Unlock()
+	var best *Listener
+	for _, l := range s.listeners {
+		if l.matches(ip, port) && (best == nil || l.specificity() > best.specificity()) {
+			best = l
+		}
+	}
+	return best
+}
+
+// SetDefaultAccept selects what happens to a SYN matching no listener, with
+// true (the default) the flow goes to Accept, with false it is reset.
+func (s *Stack) SetDefaultAccept(enabled bool) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.noDefaultAccept = !enabled
+}
+
+func (s *Stack) defaultAccept() bool {
+	s.m.Lock()
+	defer s.m.Unlock()
+	return !s.noDefaultAccept
+}
+
+// Accept waits for the next connection, see net.Listener.
+func (l *Listener) Accept() (net.Conn, error) {
+	c, err := l.AcceptTCP()
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// AcceptTCP waits for the next connection.
+func (l *Listener) AcceptTCP() (*Connection, error) {
+	select {
+	case c := <-l.accept:
+		return c, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	case <-l.s.quit:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close stops the listener, queued connections are reset. Connections
+// already accepted stay open.
+func (l *Listener) Close() error {
+	l.mu.Lock()
+	if l.closed {
+		l.mu.Unlock()
+		return net.ErrClosed
+	}
+	l.closed = true
+	close(l.done)
+	l.mu.Unlock()
+
+	l.s.m.Lock()
+	for i, o := range l.s.listeners {
+		if o == l {
+			l.s.listeners = append(l.s.listeners[:i:i], l.s.listeners[i+1:]...)
+			break
+		}
+	}
+	l.s.m.Unlock()
+
+	for {
+		select {
+		case c := <-l.accept:
+			state := c.current
+			state.lockObject.Lock()
+			c.abort(errors.New("listener closed"))
+			state.lockObject.Unlock()
+		default:
+			return nil
+		}
+	}
+}
+
+// Addr returns the address the listener was created with.
+func (l *Listener) Addr() net.Addr {
+	return &net.TCPAddr{IP: l.prefix.IP, Port: int(l.port)}
+}
+
+// enqueue hands an established connection to its listener or to Accept
+// without blocking the ingress worker, a full queue or a closed listener
+// resets the connection. The caller must hold the state lock.
+func (c *Connection) enqueue() bool {
+	queue := c.Stack.a
+	if l := c.listener; l != nil {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		if l.closed {
+			c.abort(errors.New("listener closed"))
+			return false
+		}
+		queue = l.accept
+	}
+
+	select {
+	case queue <- c:
+		return true
+	default:
+		utils.LOG.Println(common.GenerateUniqueKey(c.Src, c.Dst, c.SourcePort, c.DestinationPort),
+			"accept queue is full, reset connection")
+		c.abort(errors.New("accept queue is full"))
+		return false
+	}
+}
@@ -0,0 +1,84 @@
+package netcore
+
+import (
+	"errors"
+	"net"
+	"testing"
+)
+
+func TestParseListenAddr(t *testing.T) {
+	for _, tc := range []struct {
+		addr   string
+		prefix string
+		port   uint16
+	}{
+		{":443", "0.0.0.0/0", 443},
+		{"0.0.0.0:0", "0.0.0.0/0", 0},
+		{"10.1.2.3:80", "10.1.2.3/32", 80},
+		{"10.0.0.0/8:80", "10.0.0.0/8", 80},
+	} {
+		prefix, port, err := parseListenAddr(tc.addr)
+		if err != nil || prefix.String() != tc.prefix || port != tc.port {
+			t.Fatal("unexpected result for", tc.addr, prefix, port, err)
+		}
+	}
+	for _, addr := range []string{"10.1.2.3", "host:80", "[::1]:80", "10.1.2.3:http"} {
+		if _, _, err := parseListenAddr(addr); err == nil {
+			t.Fatal("expected an error for", addr)
+		}
+	}
+}
+
+func TestListen(t *testing.T) {
+	s, ep := newTestStack(t)
+	defer ep.Close()
+	s.SetDefaultAccept(false)
+
+	exact, err := s.Listen("tcp", "93.184.216.34:80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	subnet, err := s.Listen("tcp", "93.184.216.0/24:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = s.Listen("tcp", "93.184.216.34:80"); err == nil {
+		t.Fatal("duplicate listener")
+	}
+
+	p := newPeer(t, ep, 1000)
+	p.handshake()
+	c, err := exact.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ra := c.RemoteAddr().(*net.TCPAddr); ra.Port != 80 {
+		t.Fatal("unexpected connection", ra)
+	}
+
+	other := newPeer(t, ep, 2000)
+	other.sport = 40001
+	other.dst = net.IPv4(93, 184, 216, 35).To4()
+	other.handshake()
+	if _, err = subnet.Accept(); err != nil {
+		t.Fatal(err)
+	}
+
+	// no listener and no default accept
+	refused := newPeer(t, ep, 3000)
+	refused.sport = 40002
+	refused.dst = net.IPv4(1, 1, 1, 1).To4()
+	syn := refused.segment()
+	syn.SYN = true
+	refused.send(syn)
+	for {
+		if r := refused.recv(); r.RST {
+			break
+		}
+	}
+
+	exact.Close()
+	if _, err = exact.Accept(); !errors.Is(err, net.ErrClosed) {
+		t.Fatal("expected a closed listener", err)
+	}
+}
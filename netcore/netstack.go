@@ -1,11 +1,10 @@
 package netcore
 
 import (
+	"context"
 	"errors"
 	"fmt"
-	"io"
 	"math/rand"
-	"os"
 	"sync"
 	"syscall"
 	"time"
@@ -34,47 +33,48 @@ type Stack struct {
 
 	a    chan *Connection
 	b    chan *UDPConnection
-	epfd int
-	stop bool
-	tun  io.ReadWriteCloser
-}
+	link LinkEndpoint
 
-// New ...
-func New(fd int) (*Stack, error) {
+	quit     chan struct{}
+	quitOnce sync.Once
+	exited   chan struct{}
 
-	/*err := syscall.SetNonblock(fd, true)
-	if err != nil {
-		utils.LOG.Println("set socket option non-block failed", err)
-		return nil, err
-	}
+	workers    int
+	queueDepth int
+	d          *dispatcher
 
-	err := syscall.SetsockoptInt(fd, syscall.IPPROTO_IP, syscall.IP_HDRINCL, 1)
-	if err != nil {
-		utils.LOG.Println("set socket syscall.IPPROTO_IP failed", err)
-		return nil, err
-	}*/
+	congestion string
+	rcvBufSize int
 
-	//ep, err := syscall.EpollCreate1(0)
-	//if err != nil {
-	//	utils.LOG.Println("epoll_create1:", err.Error())
-	//	return nil, err
-	//}
-
-	//err = syscall.EpollCtl(ep, syscall.EPOLL_CTL_ADD, fd, &syscall.EpollEvent{
-	//	Events: syscall.EPOLLIN | syscall.EPOLLERR, /*| syscall.EPOLL_NONBLOCK,  | syscall.EPOLLOUT | syscall.EPOLLET*/
-	//	Fd:     int32(fd),
-	//})
-	/*if err != nil {
-		utils.LOG.Println("epollctl:", err.Error())
-		syscall.Close(ep)
-		return nil, err
-	}*/
+	challenge *rateLimiter
+	resets    *rateLimiter
+
+	listeners       []*Listener
+	noDefaultAccept bool
+
+	janitor chan struct{}
+
+	ackDelay  time.Duration
+	ackOnPush bool
+
+	timeWait      time.Duration
+	timeWaitLimit int
+	timeWaits     int
+}
+
+// New creates a stack on top of a tun file descriptor.
+func New(fd int) (*Stack, error) {
+	return NewWithEndpoint(NewFDEndpoint(fd, common.CONFIGMTU))
+}
 
-	f := os.NewFile(uintptr(fd), "")
+// NewWithEndpoint creates a stack on top of a link endpoint.
+func NewWithEndpoint(ep LinkEndpoint) (*Stack, error) {
+	if ep == nil {
+		return nil, errors.New("nil link endpoint")
+	}
 
 	v := &Stack{
-		epfd: 0,
-		r:    rand.New(rand.NewSource(time.Now().UTC().UnixNano())),
+		r: rand.New(rand.NewSource(time.Now().UTC().UnixNano())),
 		t: &StateTable{
 			table: make(map[string]*State),
 		},
@@ -82,13 +82,43 @@ func New(fd int) (*Stack, error) {
 		u: &StateTable{
 			table: make(map[string]*State),
 		},
-		b:   make(chan *UDPConnection, 50),
-		tun: f,
+		b:      make(chan *UDPConnection, 50),
+		link:   ep,
+		quit:   make(chan struct{}),
+		exited: make(chan struct{}),
+
+		congestion:    DefaultCongestionControl,
+		ackDelay:      DefaultDelayedACK,
+		timeWait:      DefaultTimeWait,
+		timeWaitLimit: DefaultTimeWaitLimit,
+		challenge:     newRateLimiter(DefaultChallengeACKLimit),
+		resets:        newRateLimiter(DefaultResetLimit),
 	}
 
 	return v, nil
 }
 
+// SetDispatcher sets the number of ingress workers and the queue depth of
+// each worker. It must be called before Start, zero means the default.
+func (s *Stack) SetDispatcher(workers, depth int) {
+	s.workers = workers
+	s.queueDepth = depth
+}
+
+// DroppedPackets returns the number of ingress packets dropped because the
+// queue of their worker was full.
+func (s *Stack) DroppedPackets() uint64 {
+	if s.d == nil {
+		return 0
+	}
+	return s.d.droppedPackets()
+}
+
+// MTU returns the mtu of the link endpoint.
+func (s *Stack) MTU() int {
+	return s.link.MTU()
+}
+
 // DefaultBufferSize ...
 var DefaultBufferSize int = ipv4.MTU
 
@@ -121,19 +151,27 @@ func (s *Stack) Start() {
 
 	}()*/
 
+	s.d = newDispatcher(s.workers, s.queueDepth, func(value []byte) {
+		s.handleEventPollIn(value)
+	})
+	s.d.start()
+
 	go func() {
+		defer close(s.exited)
+		defer s.d.stop()
 
 		for {
-			buffer := make([]byte, common.CONFIGMTU)
-			n, err := s.tun.Read(buffer)
+			buffer := make([]byte, s.link.MTU())
+			n, err := s.link.ReadPacket(buffer)
+			if err == ErrPacketTooBig {
+				utils.LOG.Println("drop oversized packet:", n)
+				continue
+			}
 			if err != nil {
 				utils.LOG.Println("Could not receive from descriptor:", err)
 				break
 			}
-			value := buffer[:n]
-			go func() {
-				s.handleEventPollIn(value)
-			}()
+			s.d.dispatch(buffer[:n])
 		}
 	}()
 }
@@ -152,6 +190,11 @@ func (s *Stack) handleEventPollIn(value []byte) error {
 		return nil
 	}*/
 
+	if len(value) < 20 {
+		utils.LOG.Println("it is not a ip packet!!!", len(value))
+		return nil
+	}
+
 	ip := ipv4.NewIPv4()
 	err := ip.TryParseBasicHeader(value[:20])
 	if err != nil {
@@ -204,25 +247,34 @@ func (s *Stack) handleTCP(ip *ipv4.IPv4) {
 			return
 		}
 
-		if !pkt.SYN {
-			relay := rst(pkt.SrcIP, pkt.DstIP, pkt.SrcPort, pkt.DstPort, pkt.Sequence, pkt.Acknowledgment, uint32(len(pkt.Payload)))
-			s.SendTo(packtcp(relay))
-			return
-		}
-
-		con := NewConnection(pkt.SrcIP, pkt.DstIP, pkt.SrcPort, pkt.DstPort, s)
-		err = con.Open(pkt)
-		if err != nil {
-			utils.LOG.Println("create connection failed")
-			pkt.Dump()
+		if !pkt.SYN || s.stopping() {
+			s.refuse(pkt)
 			return
 		}
+		s.passiveOpen(pkt, s.newISS())
 
 	} else {
 		state.Conn.dispatch(pkt)
 	}
 }
 
+// passiveOpen creates a connection for a SYN which a listener or the default
+// accept queue takes, iss is the initial send sequence number.
+func (s *Stack) passiveOpen(pkt *tcp.TCP, iss seqnum) {
+	l := s.listenerFor(pkt.DstIP, pkt.DstPort)
+	if l == nil && !s.defaultAccept() {
+		s.refuse(pkt)
+		return
+	}
+
+	con := NewConnection(pkt.SrcIP, pkt.DstIP, pkt.SrcPort, pkt.DstPort, s)
+	con.listener = l
+	if err := con.open(pkt, iss); err != nil {
+		utils.LOG.Println("create connection failed")
+		pkt.Dump()
+	}
+}
+
 func (s *Stack) handleUDP(ip *ipv4.IPv4) {
 	pkt, err := udp.TryParse(ip)
 	if err != nil {
@@ -232,6 +284,9 @@ func (s *Stack) handleUDP(ip *ipv4.IPv4) {
 
 	state := s.u.Get(pkt.SrcIP, pkt.DstIP, pkt.SrcPort, pkt.DstPort)
 	if state == nil {
+		if s.stopping() {
+			return
+		}
 		con := NewUDPConnection(pkt.SrcIP, pkt.DstIP, pkt.SrcPort, pkt.DstPort, s)
 		err = con.Open(pkt)
 		if err != nil {
@@ -248,30 +303,22 @@ func (s *Stack) handleUDP(ip *ipv4.IPv4) {
 
 // Accept ..
 func (s *Stack) Accept() (*Connection, error) {
-	if s.stop {
+	select {
+	case c := <-s.a:
+		return c, nil
+	case <-s.quit:
 		return nil, errors.New("closed")
 	}
-
-	c, ok := <-s.a
-	if !ok {
-		return nil, errors.New("channel closed")
-	}
-
-	return c, nil
 }
 
 // AcceptUDP ..
 func (s *Stack) AcceptUDP() (*UDPConnection, error) {
-	if s.stop {
+	select {
+	case c := <-s.b:
+		return c, nil
+	case <-s.quit:
 		return nil, errors.New("closed")
 	}
-
-	c, ok := <-s.b
-	if !ok {
-		return nil, errors.New("channel closed")
-	}
-
-	return c, nil
 }
 
 // SendTo ...
@@ -289,22 +336,24 @@ func (s *Stack) SendTo(data []byte) error {
 }
 
 func (s *Stack) send(data []byte) error {
-	n, err := s.tun.Write(data)
+	err := s.link.WritePacket(data)
 	if err != nil {
-		utils.LOG.Println(fmt.Sprintf("Error: %s %d\n", err.Error(), len(data)), n)
+		utils.LOG.Println(fmt.Sprintf("Error: %s %d\n", err.Error(), len(data)))
 		return err
 	}
 	return nil
 }
 
-// Close ...
+// Close shuts the stack down, waiting at most DefaultShutdownTimeout for
+// open connections to finish.
 func (s *Stack) Close() {
-	s.stop = true
-	syscall.Close(s.epfd)
-	s.tun.Close()
-	time.Sleep(time.Second * 2)
-	close(s.a)
-	close(s.b)
-	s.t.ClearAll()
-	s.u.ClearAll()
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultShutdownTimeout)
+	defer cancel()
+	s.Shutdown(ctx)
+}
+
+func (s *Stack) newISS() seqnum {
+	s.m.Lock()
+	defer s.m.Unlock()
+	return seqnum(s.r.Int31n(2147483))
 }
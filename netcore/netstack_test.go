@@ -0,0 +1,679 @@
+package netcore
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/Evan2698/netstackm/ipv4"
+	"github.com/Evan2698/netstackm/tcp"
+)
+
+// peer plays the tun-side host of one TCP flow.
+type peer struct {
+	t  *testing.T
+	ep *ChannelEndpoint
+
+	src, dst     net.IP
+	sport, dport uint16
+
+	seq, ack uint32
+	wnd      uint16
+
+	synOptions []*tcp.TCPOption
+}
+
+func newPeer(t *testing.T, ep *ChannelEndpoint, seq uint32) *peer {
+	return &peer{
+		t:     t,
+		ep:    ep,
+		src:   net.IPv4(10, 0, 0, 2).To4(),
+		dst:   net.IPv4(93, 184, 216, 34).To4(),
+		sport: 40000,
+		dport: 80,
+		seq:   seq,
+		wnd:   65535,
+	}
+}
+
+func (p *peer) segment() *tcp.TCP {
+	pak := tcp.Newtcp()
+	pak.SrcIP = p.src
+	pak.DstIP = p.dst
+	pak.SrcPort = p.sport
+	pak.DstPort = p.dport
+	pak.Sequence = p.seq
+	pak.Acknowledgment = p.ack
+	pak.WndSize = p.wnd
+	return pak
+}
+
+func (p *peer) send(pak *tcp.TCP) {
+	if err := p.ep.Inject(packtcp(pak)); err != nil {
+		p.t.Fatal("inject failed", err)
+	}
+}
+
+func (p *peer) recv() *tcp.TCP {
+	select {
+	case b := <-p.ep.Outbound():
+		ip := ipv4.NewIPv4()
+		if err := ip.TryParseBasicHeader(b[:20]); err != nil {
+			p.t.Fatal("bad ip header", err)
+		}
+		if err := ip.TryParseBody(b[20:]); err != nil {
+			p.t.Fatal("bad ip body", err)
+		}
+		pak, err := tcp.ParseTCP(ip)
+		if err != nil {
+			p.t.Fatal("bad tcp segment", err)
+		}
+		return pak
+	case <-time.After(2 * time.Second):
+		p.t.Fatal("timeout waiting for segment")
+	}
+	return nil
+}
+
+// recvData skips pure acknowledgements.
+func (p *peer) recvData() *tcp.TCP {
+	for {
+		pak := p.recv()
+		if len(pak.Payload) > 0 || pak.SYN || pak.FIN || pak.RST {
+			return pak
+		}
+	}
+}
+
+func (p *peer) handshake() *tcp.TCP {
+	syn := p.segment()
+	syn.SYN = true
+	syn.Options = p.synOptions
+	p.send(syn)
+	p.seq++
+
+	synack := p.recvData()
+	if !synack.SYN || !synack.ACK || synack.Acknowledgment != p.seq {
+		p.t.Fatal("unexpected syn-ack")
+	}
+	p.ack = synack.Sequence + 1
+
+	ack := p.segment()
+	ack.ACK = true
+	p.send(ack)
+	return synack
+}
+
+func newTestStack(t *testing.T) (*Stack, *ChannelEndpoint) {
+	return newTestStackMTU(t, 1500)
+}
+
+func newTestStackMTU(t *testing.T, mtu int) (*Stack, *ChannelEndpoint) {
+	ep := NewChannelEndpoint(mtu, 64)
+	s, err := NewWithEndpoint(ep)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Start()
+	return s, ep
+}
+
+func TestChannelEndpointTCP(t *testing.T) {
+	s, ep := newTestStack(t)
+	defer ep.Close()
+
+	p := newPeer(t, ep, 1000)
+	p.handshake()
+
+	c, err := s.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := p.segment()
+	data.ACK = true
+	data.PSH = true
+	data.Payload = []byte("hello")
+	p.send(data)
+	p.seq += uint32(len(data.Payload))
+
+	buf := make([]byte, 64)
+	n, err := c.Read(buf)
+	if err != nil || string(buf[:n]) != "hello" {
+		t.Fatal("unexpected read", n, err)
+	}
+
+	if _, err = c.Write([]byte("world")); err != nil {
+		t.Fatal(err)
+	}
+	out := p.recvData()
+	if !bytes.Equal(out.Payload, []byte("world")) || out.Sequence != p.ack {
+		t.Fatal("unexpected segment", out.Sequence, out.Payload)
+	}
+}
+
+func TestChannelEndpointTooBig(t *testing.T) {
+	ep := NewChannelEndpoint(100, 1)
+	if err := ep.Inject(make([]byte, 200)); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := ep.ReadPacket(make([]byte, 100)); n != 200 || err != ErrPacketTooBig {
+		t.Fatal("unexpected read", n, err)
+	}
+	ep.Close()
+
+	// the stack drops the packet and keeps reading
+	s, ep := newTestStack(t)
+	defer ep.Close()
+	if err := ep.Inject(make([]byte, 2000)); err != nil {
+		t.Fatal(err)
+	}
+	p := newPeer(t, ep, 1000)
+	p.handshake()
+	if _, err := s.Accept(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	s, ep := newTestStack(t)
+
+	p := newPeer(t, ep, 1000)
+	p.handshake()
+	if _, err := s.Accept(); err != nil {
+		t.Fatal(err)
+	}
+
+	idle := newPeer(t, ep, 5000)
+	idle.sport = 40001
+	idle.handshake()
+	if _, err := s.Accept(); err != nil {
+		t.Fatal(err)
+	}
+
+	type shutdown struct {
+		result *ShutdownResult
+		err    error
+	}
+	ch := make(chan shutdown, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+		defer cancel()
+		result, err := s.Shutdown(ctx)
+		ch <- shutdown{result, err}
+	}()
+
+	// only the first peer answers the FIN
+	for i := 0; i < 2; i++ {
+		fin := p.recvData()
+		if !fin.FIN {
+			t.Fatal("expected FIN")
+		}
+		if fin.DstPort != p.sport {
+			continue
+		}
+		p.seq = fin.Acknowledgment
+		p.ack = fin.Sequence + 1
+		reply := p.segment()
+		reply.ACK = true
+		reply.FIN = true
+		p.send(reply)
+	}
+
+	r := <-ch
+	if r.err != context.DeadlineExceeded {
+		t.Fatal("expected deadline error, got", r.err)
+	}
+	if r.result.Closed != 1 || len(r.result.ForceClosed) != 1 {
+		t.Fatal("unexpected result", r.result.Closed, r.result.ForceClosed)
+	}
+	if _, err := s.Accept(); err == nil {
+		t.Fatal("accept should fail after shutdown")
+	}
+}
+
+func TestRetransmit(t *testing.T) {
+	s, ep := newTestStack(t)
+	defer ep.Close()
+
+	p := newPeer(t, ep, 1000)
+	p.handshake()
+	c, err := s.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = c.Write([]byte("lost")); err != nil {
+		t.Fatal(err)
+	}
+	first := p.recvData()
+	again := p.recvData()
+	if again.Sequence != first.Sequence || !bytes.Equal(again.Payload, first.Payload) {
+		t.Fatal("expected a retransmission of the unacknowledged segment")
+	}
+
+	ack := p.segment()
+	ack.ACK = true
+	ack.Acknowledgment = first.Sequence + uint32(len(first.Payload))
+	p.send(ack)
+
+	select {
+	case pak := <-ep.Outbound():
+		t.Fatal("unexpected segment after ack", pak)
+	case <-time.After(3 * MinRTO):
+	}
+}
+
+func TestRetransmitBurstLoss(t *testing.T) {
+	s, ep := newTestStack(t)
+	defer ep.Close()
+
+	p := newPeer(t, ep, 1000)
+	p.synOptions = []*tcp.TCPOption{tcp.NewMSSOption(1000)}
+	p.handshake()
+	c, err := s.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// all four segments are lost
+	if _, err = c.Write(make([]byte, 4000)); err != nil {
+		t.Fatal(err)
+	}
+	first := p.recvData()
+	for i := 0; i < 3; i++ {
+		p.recvData()
+	}
+	if again := p.recvData(); again.Sequence != first.Sequence {
+		t.Fatal("expected the first segment", again.Sequence, first.Sequence)
+	}
+
+	// every ack brings the next segment without waiting for the timer
+	for i := uint32(1); i <= 3; i++ {
+		ack := p.segment()
+		ack.ACK = true
+		ack.Acknowledgment = first.Sequence + i*1000
+		p.send(ack)
+		start := time.Now()
+		out := p.recvData()
+		if out.Sequence != ack.Acknowledgment || time.Since(start) > MinRTO/2 {
+			t.Fatal("expected the next segment at once", out.Sequence, ack.Acknowledgment, time.Since(start))
+		}
+	}
+}
+
+func TestWindowUpdateNotDuplicate(t *testing.T) {
+	s, ep := newTestStack(t)
+	defer ep.Close()
+
+	p := newPeer(t, ep, 1000)
+	p.synOptions = []*tcp.TCPOption{tcp.NewMSSOption(1000)}
+	p.handshake()
+	c, err := s.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = c.Write(make([]byte, 4000)); err != nil {
+		t.Fatal(err)
+	}
+	first := p.recvData()
+	for i := 0; i < 3; i++ {
+		p.recvData()
+	}
+
+	// the peer drains its buffer and announces every change
+	for i := 1; i <= 3; i++ {
+		p.wnd = uint16(65535 - i*1000)
+		update := p.segment()
+		update.ACK = true
+		update.Acknowledgment = first.Sequence
+		p.send(update)
+	}
+
+	select {
+	case pak := <-ep.Outbound():
+		t.Fatal("window updates must not trigger fast retransmit", len(pak))
+	case <-time.After(MinRTO / 2):
+	}
+	c.current.lockObject.Lock()
+	recovery := c.current.inRecovery
+	c.current.lockObject.Unlock()
+	if recovery {
+		t.Fatal("window updates started a recovery")
+	}
+}
+
+func TestZeroWindow(t *testing.T) {
+	s, ep := newTestStack(t)
+	defer ep.Close()
+
+	p := newPeer(t, ep, 1000)
+	p.wnd = 0
+	p.handshake()
+	c, err := s.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	written := make(chan error, 1)
+	go func() {
+		_, err := c.Write([]byte("blocked"))
+		written <- err
+	}()
+
+	probe := p.recv()
+	for probe.Sequence == p.ack && len(probe.Payload) == 0 {
+		probe = p.recv()
+	}
+	if len(probe.Payload) != 0 || probe.Sequence != p.ack-1 {
+		t.Fatal("expected a zero window probe", probe.Sequence, p.ack)
+	}
+	// the data waits in the send buffer
+	if err := <-written; err != nil {
+		t.Fatal(err)
+	}
+
+	p.wnd = 65535
+	open := p.segment()
+	open.ACK = true
+	p.send(open)
+
+	out := p.recvData()
+	if string(out.Payload) != "blocked" {
+		t.Fatal("unexpected segment", out.Payload)
+	}
+}
+
+func TestOutOfWindowAck(t *testing.T) {
+	s, ep := newTestStack(t)
+	defer ep.Close()
+
+	p := newPeer(t, ep, 1000)
+	p.handshake()
+	c, err := s.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// far outside the receive window, answered with an ack and dropped
+	p.wnd = 0
+	bogus := p.segment()
+	bogus.ACK = true
+	bogus.Sequence = p.seq + 10000000
+	p.send(bogus)
+	if a := p.recv(); a.Acknowledgment != p.seq {
+		t.Fatal("expected an ack", a.Acknowledgment, p.seq)
+	}
+
+	p.wnd = 65535
+	valid := p.segment()
+	valid.ACK = true
+	p.send(valid)
+	if _, err = c.Write([]byte("data")); err != nil {
+		t.Fatal(err)
+	}
+	if out := p.recvData(); string(out.Payload) != "data" {
+		t.Fatal("unexpected segment", len(out.Payload))
+	}
+}
+
+func TestMSSNegotiation(t *testing.T) {
+	s, ep := newTestStackMTU(t, 1280)
+	defer ep.Close()
+
+	p := newPeer(t, ep, 1000)
+	p.synOptions = []*tcp.TCPOption{tcp.NewMSSOption(1200)}
+	synack := p.handshake()
+	if mss, ok := synack.MSS(); !ok || mss != 1240 {
+		t.Fatal("unexpected advertised mss", mss, ok)
+	}
+
+	c, err := s.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = c.Write(make([]byte, 3000)); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []int{1200, 1200, 600} {
+		if out := p.recvData(); len(out.Payload) != want {
+			t.Fatal("unexpected segment size", len(out.Payload), want)
+		}
+	}
+}
+
+func TestTinyMSS(t *testing.T) {
+	for _, mss := range []uint16{0, 1, 8, 12} {
+		s, ep := newTestStack(t)
+
+		p := newPeer(t, ep, 1000)
+		p.synOptions = []*tcp.TCPOption{tcp.NewMSSOption(mss)}
+		p.handshake()
+		c, err := s.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.SetNoDelay(true)
+		if _, err = c.Write(make([]byte, 200)); err != nil {
+			t.Fatal(err)
+		}
+		want := MinMSS
+		if mss == 0 {
+			want = 200
+		}
+		if out := p.recvData(); len(out.Payload) != want {
+			t.Fatal("unexpected segment size", mss, len(out.Payload), want)
+		}
+		ep.Close()
+	}
+}
+
+func TestWindowScale(t *testing.T) {
+	s, ep := newTestStack(t)
+	defer ep.Close()
+	s.SetReceiveBufferSize(1 << 20)
+
+	p := newPeer(t, ep, 1000)
+	p.synOptions = []*tcp.TCPOption{tcp.NewMSSOption(1460), tcp.NewWindowScaleOption(7)}
+	synack := p.handshake()
+	if shift, ok := synack.WindowScale(); !ok || shift != 5 {
+		t.Fatal("unexpected window scale", shift, ok)
+	}
+	if synack.WndSize != 0xffff {
+		t.Fatal("the window of a SYN must not be scaled", synack.WndSize)
+	}
+
+	c, err := s.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a window of 10 scaled by 7 allows 1280 bytes
+	p.wnd = 10
+	small := p.segment()
+	small.ACK = true
+	small.Payload = []byte("x")
+	p.send(small)
+	p.seq++
+
+	buf := make([]byte, 1)
+	if _, err = c.Read(buf); err != nil {
+		t.Fatal(err)
+	}
+	// the 280 byte tail would wait for the first segment otherwise
+	c.SetNoDelay(true)
+	if _, err = c.Write(make([]byte, 1000)); err != nil {
+		t.Fatal(err)
+	}
+	go c.Write(make([]byte, 1000))
+
+	if out := p.recvData(); len(out.Payload) != 1000 {
+		t.Fatal("unexpected segment size", len(out.Payload))
+	}
+	if out := p.recvData(); len(out.Payload) != 280 {
+		t.Fatal("unexpected segment size", len(out.Payload))
+	}
+}
+
+func TestCloseWait(t *testing.T) {
+	s, ep := newTestStack(t)
+	defer ep.Close()
+
+	p := newPeer(t, ep, 1000)
+	p.handshake()
+	c, err := s.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fin := p.segment()
+	fin.ACK = true
+	fin.FIN = true
+	fin.Payload = []byte("request")
+	p.send(fin)
+	p.seq += uint32(len(fin.Payload)) + 1
+
+	reply := p.recv()
+	for reply.Acknowledgment != p.seq && !reply.FIN {
+		reply = p.recv()
+	}
+	if reply.FIN {
+		t.Fatal("the FIN must only be acknowledged")
+	}
+
+	data, err := io.ReadAll(c)
+	if err != nil || string(data) != "request" {
+		t.Fatal("unexpected read", string(data), err)
+	}
+
+	// the response still goes out after the peer's FIN
+	if _, err = c.Write([]byte("response")); err != nil {
+		t.Fatal(err)
+	}
+	out := p.recvData()
+	if string(out.Payload) != "response" || out.FIN {
+		t.Fatal("unexpected segment", out.Payload, out.FIN)
+	}
+	p.ack += uint32(len(out.Payload))
+
+	c.Close()
+	last := p.recvData()
+	if !last.FIN || last.Sequence != p.ack {
+		t.Fatal("expected our FIN", last.FIN, last.Sequence)
+	}
+	p.ack++
+	done := p.segment()
+	done.ACK = true
+	p.send(done)
+
+	select {
+	case <-c.done:
+	case <-time.After(time.Second):
+		t.Fatal("connection did not close")
+	}
+}
+
+func TestCloseWrite(t *testing.T) {
+	s, ep := newTestStack(t)
+	defer ep.Close()
+
+	p := newPeer(t, ep, 1000)
+	p.handshake()
+	c, err := s.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = c.CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+	fin := p.recvData()
+	if !fin.FIN || fin.Sequence != p.ack {
+		t.Fatal("expected our FIN", fin.FIN, fin.Sequence)
+	}
+	p.ack++
+	if _, err = c.Write([]byte("late")); err == nil {
+		t.Fatal("write after CloseWrite must fail")
+	}
+
+	// the peer acknowledges the FIN and keeps sending
+	data := p.segment()
+	data.ACK = true
+	data.Payload = []byte("response")
+	p.send(data)
+	p.seq += uint32(len(data.Payload))
+
+	last := p.segment()
+	last.ACK = true
+	last.FIN = true
+	p.send(last)
+
+	got, err := io.ReadAll(c)
+	if err != nil || string(got) != "response" {
+		t.Fatal("unexpected read", string(got), err)
+	}
+
+	c.current.lockObject.Lock()
+	st := c.current.SocketState
+	c.current.lockObject.Unlock()
+	if st != SocketTimeWait {
+		t.Fatal("unexpected state", st.String())
+	}
+}
+
+func TestReset(t *testing.T) {
+	s, ep := newTestStack(t)
+	defer ep.Close()
+
+	p := newPeer(t, ep, 1000)
+	p.handshake()
+	c, err := s.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	read := make(chan error, 1)
+	go func() {
+		_, err := c.Read(make([]byte, 16))
+		read <- err
+	}()
+
+	// a RST inside the window but not at RecvNext is challenged
+	blind := p.segment()
+	blind.RST = true
+	blind.Sequence = p.seq + 100
+	p.send(blind)
+	challenge := p.recv()
+	for challenge.Acknowledgment != p.seq || challenge.RST {
+		challenge = p.recv()
+	}
+	select {
+	case err := <-read:
+		t.Fatal("blind reset closed the connection", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	reset := p.segment()
+	reset.RST = true
+	p.send(reset)
+	select {
+	case err := <-read:
+		if !errors.Is(err, syscall.ECONNRESET) {
+			t.Fatal("expected ECONNRESET", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("reset did not wake the reader")
+	}
+	if _, err = c.Write([]byte("x")); !errors.Is(err, syscall.ECONNRESET) {
+		t.Fatal("expected ECONNRESET", err)
+	}
+	if len(s.t.Snapshot()) != 0 {
+		t.Fatal("the state was not removed")
+	}
+}
@@ -0,0 +1,67 @@
+package netcore
+
+import (
+	"math"
+	"time"
+)
+
+// NewReno implements the congestion avoidance of RFC 5681, the fast
+// recovery of RFC 6582 is driven by the connection.
+type NewReno struct {
+	mss      int
+	cwnd     int
+	ssthresh int
+	acked    int
+}
+
+// NewNewReno ...
+func NewNewReno(mss int) CongestionControl {
+	return &NewReno{
+		mss:      mss,
+		cwnd:     initialWindow(mss),
+		ssthresh: math.MaxInt32,
+	}
+}
+
+// OnAck ...
+func (r *NewReno) OnAck(acked int, rtt time.Duration) {
+	if r.cwnd < r.ssthresh {
+		// slow start
+		if acked > r.mss {
+			acked = r.mss
+		}
+		r.cwnd += acked
+		return
+	}
+
+	// congestion avoidance, one segment per window
+	r.acked += acked
+	if r.acked >= r.cwnd {
+		r.acked -= r.cwnd
+		r.cwnd += r.mss
+	}
+}
+
+// OnLoss ...
+func (r *NewReno) OnLoss(inFlight int) {
+	r.ssthresh = lossThreshold(inFlight, r.mss)
+	r.cwnd = r.ssthresh
+	r.acked = 0
+}
+
+// OnTimeout ...
+func (r *NewReno) OnTimeout(inFlight int) {
+	r.ssthresh = lossThreshold(inFlight, r.mss)
+	r.cwnd = r.mss
+	r.acked = 0
+}
+
+// Window ...
+func (r *NewReno) Window() int {
+	return r.cwnd
+}
+
+// Threshold ...
+func (r *NewReno) Threshold() int {
+	return r.ssthresh
+}
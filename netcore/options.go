@@ -0,0 +1,110 @@
+package netcore
+
+import (
+	"time"
+
+	"github.com/Evan2698/netstackm/tcp"
+)
+
+const (
+	// DefaultMSS is assumed when the peer's SYN carries no MSS option
+	// (RFC 1122).
+	DefaultMSS = 536
+	// MinMSS is the smallest segment size we send whatever the peer
+	// announces, like TCP_MIN_MSS of Linux.
+	MinMSS = 88
+
+	// headerSize is the size of the ip and tcp headers without options.
+	headerSize = 40
+)
+
+// negotiate takes the options of the peer's SYN or SYN-ACK, options the
+// peer does not send are turned off. The caller must hold the state lock.
+func (c *Connection) negotiate(syn *tcp.TCP) {
+	state := c.current
+	state.rcvMSS = c.Stack.MTU() - headerSize
+
+	peer := DefaultMSS
+	if mss, ok := syn.MSS(); ok && mss > 0 {
+		peer = int(mss)
+	}
+	state.sendMSS = peer
+	if state.sendMSS > state.rcvMSS {
+		state.sendMSS = state.rcvMSS
+	}
+
+	// window scaling is used only when both sides offer it (RFC 7323)
+	if shift, ok := syn.WindowScale(); ok {
+		state.wsEnabled = true
+		state.sndWndShift = shift
+		if state.sndWndShift > maxWindowShift {
+			state.sndWndShift = maxWindowShift
+		}
+		state.rcvWndShift = windowShift(state.rcvBufSize)
+	} else {
+		state.wsEnabled = false
+		state.sndWndShift = 0
+		state.rcvWndShift = 0
+	}
+
+	state.sackEnabled = syn.SACKPermitted()
+
+	state.tsEnabled = false
+	if val, _, ok := syn.Timestamps(); ok {
+		state.tsEnabled = true
+		state.tsRecent = val
+		state.tsRecentAge = time.Now()
+		// every data segment carries the option, the floor below applies
+		// to what is left for data
+		if state.sendMSS > timestampsSize {
+			state.sendMSS -= timestampsSize
+		}
+	}
+	if state.sendMSS < MinMSS {
+		state.sendMSS = MinMSS
+	}
+	state.inMSS = state.sendMSS
+	if state.inMSS > DefaultMSS {
+		state.inMSS = DefaultMSS
+	}
+}
+
+// offer prepares the options of our SYN in an active open. Everything is
+// offered, negotiate keeps what the SYN-ACK confirms. The caller must hold
+// the state lock.
+func (c *Connection) offer() {
+	state := c.current
+	state.rcvMSS = c.Stack.MTU() - headerSize
+	state.sendMSS = DefaultMSS
+	state.wsEnabled = true
+	state.rcvWndShift = windowShift(state.rcvBufSize)
+	state.sackEnabled = true
+	state.tsEnabled = true
+}
+
+// windowShift returns the smallest shift count which lets a 16 bit window
+// field cover size.
+func windowShift(size int) uint8 {
+	var shift uint8
+	for shift < maxWindowShift && size>>shift > 0xffff {
+		shift++
+	}
+	return shift
+}
+
+// synOptions returns the options of our SYN or SYN-ACK.
+func synOptions(state *State) []*tcp.TCPOption {
+	opts := []*tcp.TCPOption{
+		tcp.NewMSSOption(uint16(state.rcvMSS)),
+	}
+	if state.wsEnabled {
+		opts = append(opts, tcp.NewNOPOption(), tcp.NewWindowScaleOption(state.rcvWndShift))
+	}
+	if state.sackEnabled {
+		opts = append(opts, tcp.NewNOPOption(), tcp.NewNOPOption(), tcp.NewSACKPermittedOption())
+	}
+	if state.tsEnabled {
+		opts = append(opts, timestampsOption(state)...)
+	}
+	return opts
+}
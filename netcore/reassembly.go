@@ -0,0 +1,146 @@
+package netcore
+
+import (
+	"sort"
+
+	"github.com/Evan2698/netstackm/tcp"
+)
+
+// oooSegment is a segment received ahead of RecvNext.
+type oooSegment struct {
+	seq  seqnum
+	data []byte
+	fin  bool
+}
+
+func (s *oooSegment) end() seqnum {
+	return s.seq.add(uint32(len(s.data)))
+}
+
+// reassembler keeps out-of-order segments sorted by sequence number and
+// without overlaps. The buffered payload is bounded by the receive buffer
+// size.
+type reassembler struct {
+	segs  []*oooSegment
+	size  int
+	limit int
+
+	// the most recently queued segment, reported first in SACK blocks
+	last seqnum
+}
+
+func newReassembler(limit int) *reassembler {
+	return &reassembler{
+		limit: limit,
+	}
+}
+
+// insert stores a segment which starts after next, overlapping bytes are
+// stored once. It returns false when the segment does not fit into the byte
+// limit.
+func (r *reassembler) insert(next, seq seqnum, data []byte, fin bool) bool {
+	if r.size+len(data) > r.limit {
+		return false
+	}
+
+	for _, s := range r.segs {
+		if len(data) == 0 {
+			break
+		}
+		// new segment starts inside s
+		if seq.inRange(s.seq, s.end()) {
+			cut := seq.size(s.end())
+			if int(cut) >= len(data) {
+				data = nil
+			} else {
+				data = data[cut:]
+			}
+			seq = s.end()
+		}
+	}
+
+	if len(data) == 0 && !fin {
+		return true
+	}
+
+	r.last = seq
+	buf := make([]byte, len(data))
+	copy(buf, data)
+	r.segs = append(r.segs, &oooSegment{seq: seq, data: buf, fin: fin})
+	sort.Slice(r.segs, func(i, j int) bool {
+		return next.size(r.segs[i].seq) < next.size(r.segs[j].seq)
+	})
+	r.normalize()
+	return true
+}
+
+// normalize trims the head of every segment overlapping its predecessor.
+func (r *reassembler) normalize() {
+	out := r.segs[:0]
+	r.size = 0
+	for _, s := range r.segs {
+		if len(out) > 0 {
+			prev := out[len(out)-1]
+			if s.seq.lessThan(prev.end()) {
+				cut := s.seq.size(prev.end())
+				if int(cut) >= len(s.data) {
+					prev.fin = prev.fin || s.fin
+					continue
+				}
+				s.data = s.data[cut:]
+				s.seq = prev.end()
+			}
+		}
+		out = append(out, s)
+		r.size += len(s.data)
+	}
+	r.segs = out
+}
+
+// pop removes the buffered data contiguous with next. It returns the data
+// and whether a FIN follows it.
+func (r *reassembler) pop(next seqnum) ([]byte, bool) {
+	var data []byte
+	fin := false
+	for len(r.segs) > 0 {
+		s := r.segs[0]
+		if next.lessThan(s.seq) {
+			break
+		}
+		r.segs = r.segs[1:]
+		r.size -= len(s.data)
+
+		if next.lessThan(s.end()) {
+			chunk := s.data[s.seq.size(next):]
+			data = append(data, chunk...)
+			next = next.add(uint32(len(chunk)))
+		}
+		if s.fin {
+			fin = true
+			break
+		}
+	}
+	return data, fin
+}
+
+// ranges returns the queued sequence ranges with adjacent segments merged.
+func (r *reassembler) ranges() []tcp.SACKBlock {
+	var out []tcp.SACKBlock
+	for _, s := range r.segs {
+		if n := len(out); n > 0 && seqnum(out[n-1].Right) == s.seq {
+			out[n-1].Right = uint32(s.end())
+			continue
+		}
+		out = append(out, tcp.SACKBlock{Left: uint32(s.seq), Right: uint32(s.end())})
+	}
+	return out
+}
+
+func (r *reassembler) empty() bool {
+	return len(r.segs) == 0
+}
+
+func (r *reassembler) reset() {
+	r.segs = nil
+	r.size = 0
+}
@@ -0,0 +1,70 @@
+package netcore
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestReassembler(t *testing.T) {
+	r := newReassembler(100)
+
+	// next is 0xfffffffe so the queue crosses the 32-bit boundary
+	next := seqnum(0xfffffffe)
+	r.insert(next, next+6, []byte("ghij"), false)
+	r.insert(next, next+4, []byte("efgh"), false)
+	r.insert(next, next+2, []byte("cd"), false)
+	if r.size != 8 {
+		t.Fatal("overlap was not trimmed, size", r.size)
+	}
+
+	if data, _ := r.pop(next); len(data) != 0 {
+		t.Fatal("gap at next must not be delivered")
+	}
+
+	data, fin := r.pop(next + 2)
+	if !bytes.Equal(data, []byte("cdefghij")) || fin {
+		t.Fatal("unexpected data", string(data))
+	}
+	if !r.empty() {
+		t.Fatal("queue should be empty")
+	}
+
+	if r.insert(next, next+1, make([]byte, 101), false) {
+		t.Fatal("segment over the byte limit was accepted")
+	}
+}
+
+func TestOutOfOrderDelivery(t *testing.T) {
+	s, ep := newTestStack(t)
+	defer ep.Close()
+
+	p := newPeer(t, ep, 1000)
+	p.handshake()
+	c, err := s.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	seg := func(off uint32, payload string) {
+		pak := p.segment()
+		pak.ACK = true
+		pak.Sequence = p.seq + off
+		pak.Payload = []byte(payload)
+		p.send(pak)
+	}
+	seg(5, "world")
+	seg(0, "hello")
+
+	buf := make([]byte, 64)
+	got := []byte{}
+	for len(got) < 10 {
+		n, err := c.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, buf[:n]...)
+	}
+	if string(got) != "helloworld" {
+		t.Fatal("unexpected data", string(got))
+	}
+}
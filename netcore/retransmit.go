@@ -0,0 +1,280 @@
+package netcore
+
+import (
+	"syscall"
+	"time"
+
+	"github.com/Evan2698/chimney/utils"
+	"github.com/Evan2698/netstackm/common"
+	"github.com/Evan2698/netstackm/tcp"
+)
+
+const (
+	// InitialRTO is the retransmission timeout before the first RTT sample.
+	InitialRTO = time.Second
+	// MinRTO is the lower bound of the retransmission timeout.
+	MinRTO = 200 * time.Millisecond
+	// MaxRTO is the upper bound of the retransmission timeout.
+	MaxRTO = 60 * time.Second
+	// MaxRetransmits is the number of retransmissions of one segment before
+	// the connection is reset.
+	MaxRetransmits = 8
+
+	clockGranularity = time.Millisecond
+)
+
+// segment is a sent segment waiting to be acknowledged.
+type segment struct {
+	seq  seqnum
+	data []byte
+	syn  bool
+	fin  bool
+
+	sent          time.Time
+	retransmitted bool
+	sacked        bool
+}
+
+// length returns the sequence space occupied by the segment.
+func (s *segment) length() uint32 {
+	n := uint32(len(s.data))
+	if s.syn {
+		n++
+	}
+	if s.fin {
+		n++
+	}
+	return n
+}
+
+// end returns the sequence number following the segment.
+func (s *segment) end() seqnum {
+	return s.seq.add(s.length())
+}
+
+// build turns a segment into a tcp packet using the current ack number and
+// window of the connection.
+func (s *segment) build(state *State) *tcp.TCP {
+	var pak *tcp.TCP
+	switch {
+	case s.syn && state.SocketState == SocketSynSent:
+		pak = syn(state)
+	case s.syn:
+		pak = synack(state)
+	case s.fin:
+		pak = finAck(state)
+	default:
+		pak = payload(state, s.data)
+	}
+	pak.Sequence = uint32(s.seq)
+	return pak
+}
+
+// sendSegment transmits a new segment and queues it for retransmission.
+// The caller must hold the state lock and advance SendNext.
+func (c *Connection) sendSegment(seg *segment) {
+	state := c.current
+	seg.sent = time.Now()
+	c.Stack.SendTo(packtcp(seg.build(state)))
+	state.unacked = append(state.unacked, seg)
+	if state.rtoTimer == nil {
+		c.armRetransmit()
+	}
+}
+
+// armRetransmit (re)starts the retransmission timer. The caller must hold
+// the state lock.
+func (c *Connection) armRetransmit() {
+	state := c.current
+	if state.rtoTimer != nil {
+		state.rtoTimer.Stop()
+	}
+	state.rtoGen++
+	gen := state.rtoGen
+	state.rtoTimer = time.AfterFunc(state.rto, func() {
+		c.retransmitTimeout(gen)
+	})
+}
+
+// stopRetransmit stops the retransmission timer. The caller must hold the
+// state lock.
+func (c *Connection) stopRetransmit() {
+	state := c.current
+	if state.rtoTimer != nil {
+		state.rtoTimer.Stop()
+		state.rtoTimer = nil
+	}
+	state.rtoGen++
+}
+
+// processAck removes the segments covered by the ack of t from the
+// retransmission queue, takes an RTT sample from the echoed timestamp or
+// the send time and drives the congestion control. wnd is the send window
+// before t, an ack changing it is not counted as a duplicate (RFC 5681
+// section 2). The caller must hold the state lock.
+func (c *Connection) processAck(t *tcp.TCP, wnd uint32) {
+	state := c.current
+	ack := seqnum(t.Acknowledgment)
+	// ignore acks for data we never sent
+	if state.SendNext.lessThan(ack) {
+		return
+	}
+	if ack.lessThanEq(state.SendUnAcknowledged) {
+		if ack == state.SendUnAcknowledged && len(t.Payload) == 0 && !t.SYN && !t.FIN &&
+			len(state.unacked) > 0 && state.sendWindow == wnd {
+			c.duplicateAck()
+		}
+		return
+	}
+
+	acked := int(state.SendUnAcknowledged.size(ack))
+	now := time.Now()
+	rtt, measured := timestampsRTT(state, t)
+	if measured {
+		c.sampleRTT(rtt)
+	}
+	i := 0
+	for ; i < len(state.unacked); i++ {
+		seg := state.unacked[i]
+		if ack.lessThan(seg.end()) {
+			break
+		}
+		// Karn's algorithm, never sample a retransmitted segment
+		if !measured && !seg.retransmitted {
+			c.sampleRTT(now.Sub(seg.sent))
+		}
+		if seg.sacked {
+			state.sacked -= seg.length()
+		}
+	}
+	state.unacked = state.unacked[i:]
+	state.SendUnAcknowledged = ack
+	if state.highSacked.lessThan(ack) {
+		state.highSacked = ack
+	}
+	state.LastAcked = ack
+	state.retries = 0
+	state.dupAcks = 0
+
+	if state.inRecovery {
+		if state.recover.lessThanEq(ack) {
+			state.inRecovery = false
+		} else if len(state.unacked) > 0 {
+			// a partial ack, the next segment was lost as well (RFC 6582)
+			if !state.sackEnabled || !c.retransmitHole() {
+				c.retransmitHead()
+			}
+		}
+	} else {
+		state.cc.OnAck(acked, state.srtt)
+	}
+	c.notifyWritable()
+
+	if len(state.unacked) == 0 {
+		c.stopRetransmit()
+	} else {
+		c.armRetransmit()
+	}
+}
+
+// duplicateAck counts duplicate acks and starts fast retransmit on the
+// third one. The caller must hold the state lock.
+func (c *Connection) duplicateAck() {
+	state := c.current
+	state.dupAcks++
+	if state.inRecovery {
+		// with SACK a further duplicate ack fills the next hole while the
+		// congestion window allows (RFC 6675 section 5)
+		if state.sackEnabled && c.pipe() < uint32(state.cc.Window()) {
+			c.retransmitHole()
+		}
+		return
+	}
+	if state.dupAcks != 3 {
+		return
+	}
+
+	state.cc.OnLoss(int(c.inFlight()))
+	state.inRecovery = true
+	state.recover = state.SendNext
+	c.retransmitHead()
+}
+
+// retransmitHead resends the oldest unacknowledged segment. The caller must
+// hold the state lock.
+func (c *Connection) retransmitHead() {
+	state := c.current
+	seg := state.unacked[0]
+	seg.retransmitted = true
+	seg.sent = time.Now()
+	c.Stack.SendTo(packtcp(seg.build(state)))
+	c.armRetransmit()
+}
+
+// sampleRTT updates the RTT estimators as described in RFC 6298.
+func (c *Connection) sampleRTT(rtt time.Duration) {
+	state := c.current
+	if state.srtt == 0 {
+		state.srtt = rtt
+		state.rttvar = rtt / 2
+	} else {
+		delta := state.srtt - rtt
+		if delta < 0 {
+			delta = -delta
+		}
+		state.rttvar = (3*state.rttvar + delta) / 4
+		state.srtt = (7*state.srtt + rtt) / 8
+	}
+
+	k := 4 * state.rttvar
+	if k < clockGranularity {
+		k = clockGranularity
+	}
+	state.rto = state.srtt + k
+	if state.rto < MinRTO {
+		state.rto = MinRTO
+	}
+	if state.rto > MaxRTO {
+		state.rto = MaxRTO
+	}
+}
+
+// retransmitTimeout resends the oldest unacknowledged segment and backs off
+// the timer, the connection is reset after MaxRetransmits attempts. Until
+// everything sent so far is acknowledged every ack resends the next segment
+// (go-back-N, RFC 5681 section 3.1). gen tells a stale timer from the
+// current one.
+func (c *Connection) retransmitTimeout(gen int) {
+	state := c.current
+	state.lockObject.Lock()
+	defer state.lockObject.Unlock()
+
+	if gen != state.rtoGen {
+		return
+	}
+	state.rtoTimer = nil
+	if c.closed || len(state.unacked) == 0 {
+		return
+	}
+
+	state.retries++
+	if state.retries > MaxRetransmits {
+		utils.LOG.Println(common.GenerateUniqueKey(c.Src, c.Dst, c.SourcePort, c.DestinationPort),
+			"too many retransmissions, reset connection")
+		c.abort(syscall.ETIMEDOUT)
+		return
+	}
+
+	state.rto *= 2
+	if state.rto > MaxRTO {
+		state.rto = MaxRTO
+	}
+
+	state.cc.OnTimeout(int(c.inFlight()))
+	// acks below recover are partial acks (RFC 6582 section 3.2)
+	state.inRecovery = true
+	state.recover = state.SendNext
+	state.dupAcks = 0
+	c.clearSACK()
+	c.retransmitHead()
+}
@@ -0,0 +1,103 @@
+package netcore
+
+import (
+	"time"
+
+	"github.com/Evan2698/netstackm/tcp"
+)
+
+const (
+	// maxSACKBlocks is the number of blocks fitting into the option space
+	// of an ack.
+	maxSACKBlocks = 4
+	// maxSACKBlocksTimestamps is the number of blocks fitting next to the
+	// timestamps option.
+	maxSACKBlocksTimestamps = 3
+)
+
+// sackBlocks describes the out-of-order queue, the block holding the most
+// recently received segment goes first (RFC 2018).
+func sackBlocks(state *State) []tcp.SACKBlock {
+	limit := maxSACKBlocks
+	if state.tsEnabled {
+		limit = maxSACKBlocksTimestamps
+	}
+	ranges := state.ooo.ranges()
+	blocks := make([]tcp.SACKBlock, 0, limit)
+	for i, b := range ranges {
+		if state.ooo.last.inRange(seqnum(b.Left), seqnum(b.Right)) {
+			blocks = append(blocks, b)
+			ranges = append(ranges[:i:i], ranges[i+1:]...)
+			break
+		}
+	}
+	for _, b := range ranges {
+		if len(blocks) == limit {
+			break
+		}
+		blocks = append(blocks, b)
+	}
+	return blocks
+}
+
+// processSACK marks the queued segments covered by the SACK blocks of t.
+// The caller must hold the state lock.
+func (c *Connection) processSACK(t *tcp.TCP) {
+	state := c.current
+	if !state.sackEnabled {
+		return
+	}
+	for _, b := range t.SACKBlocks() {
+		// ignore blocks outside of what is in flight
+		left, right := seqnum(b.Left), seqnum(b.Right)
+		if left.lessThan(state.SendUnAcknowledged) || state.SendNext.lessThan(right) {
+			continue
+		}
+		for _, seg := range state.unacked {
+			if left.lessThanEq(seg.seq) && seg.end().lessThanEq(right) && !seg.sacked {
+				seg.sacked = true
+				state.sacked += seg.length()
+				if state.highSacked.lessThan(seg.end()) {
+					state.highSacked = seg.end()
+				}
+			}
+		}
+	}
+}
+
+// pipe returns the bytes in flight not known to have left the network.
+func (c *Connection) pipe() uint32 {
+	return c.inFlight() - c.current.sacked
+}
+
+// retransmitHole resends the first segment below the highest SACKed byte
+// which is neither SACKed nor already retransmitted in this recovery. It
+// reports whether a hole was found. The caller must hold the state lock.
+func (c *Connection) retransmitHole() bool {
+	state := c.current
+	for _, seg := range state.unacked {
+		if state.highSacked.lessThan(seg.end()) {
+			break
+		}
+		if seg.sacked || seg.retransmitted {
+			continue
+		}
+		seg.retransmitted = true
+		seg.sent = time.Now()
+		c.Stack.SendTo(packtcp(seg.build(state)))
+		c.armRetransmit()
+		return true
+	}
+	return false
+}
+
+// clearSACK forgets the SACK scoreboard, the peer may renege on SACKed
+// data (RFC 2018). The caller must hold the state lock.
+func (c *Connection) clearSACK() {
+	state := c.current
+	for _, seg := range state.unacked {
+		seg.sacked = false
+	}
+	state.sacked = 0
+	state.highSacked = state.SendUnAcknowledged
+}
@@ -0,0 +1,132 @@
+package netcore
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Evan2698/netstackm/tcp"
+)
+
+func TestSACKGeneration(t *testing.T) {
+	_, ep := newTestStack(t)
+	defer ep.Close()
+
+	p := newPeer(t, ep, 1000)
+	p.synOptions = []*tcp.TCPOption{tcp.NewSACKPermittedOption()}
+	if synack := p.handshake(); !synack.SACKPermitted() {
+		t.Fatal("sack permitted was not echoed")
+	}
+
+	ahead := p.segment()
+	ahead.ACK = true
+	ahead.Sequence = p.seq + 10
+	ahead.Payload = []byte("later")
+	p.send(ahead)
+
+	for {
+		dup := p.recv()
+		blocks := dup.SACKBlocks()
+		if len(blocks) == 0 {
+			continue
+		}
+		if dup.Acknowledgment != p.seq || blocks[0].Left != p.seq+10 || blocks[0].Right != p.seq+15 {
+			t.Fatal("unexpected sack", dup.Acknowledgment, blocks)
+		}
+		break
+	}
+}
+
+func TestSACKRecovery(t *testing.T) {
+	s, ep := newTestStack(t)
+	defer ep.Close()
+
+	p := newPeer(t, ep, 1000)
+	p.synOptions = []*tcp.TCPOption{tcp.NewMSSOption(1000), tcp.NewSACKPermittedOption()}
+	p.handshake()
+	c, err := s.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = c.Write(make([]byte, 4000)); err != nil {
+		t.Fatal(err)
+	}
+	first := p.recvData()
+	for i := 0; i < 3; i++ {
+		p.recvData()
+	}
+
+	// the first segment is lost, the other three arrive
+	for i := uint32(2); i <= 4; i++ {
+		dup := p.segment()
+		dup.ACK = true
+		dup.Acknowledgment = first.Sequence
+		dup.Options = []*tcp.TCPOption{tcp.NewSACKOption([]tcp.SACKBlock{
+			{Left: first.Sequence + 1000, Right: first.Sequence + i*1000},
+		})}
+		p.send(dup)
+	}
+
+	again := p.recvData()
+	if again.Sequence != first.Sequence {
+		t.Fatal("expected the lost segment", again.Sequence, first.Sequence)
+	}
+
+	done := p.segment()
+	done.ACK = true
+	done.Acknowledgment = first.Sequence + 4000
+	p.send(done)
+
+	select {
+	case pak := <-ep.Outbound():
+		t.Fatal("only the hole should be retransmitted", pak)
+	case <-time.After(3 * MinRTO):
+	}
+}
+
+func TestSACKRecoveryPipe(t *testing.T) {
+	s, ep := newTestStack(t)
+	defer ep.Close()
+	s.SetCongestionControl("newreno")
+
+	p := newPeer(t, ep, 1000)
+	p.synOptions = []*tcp.TCPOption{tcp.NewMSSOption(1000), tcp.NewSACKPermittedOption()}
+	p.handshake()
+	c, err := s.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = c.Write(make([]byte, 4000)); err != nil {
+		t.Fatal(err)
+	}
+	first := p.recvData()
+	for i := 0; i < 3; i++ {
+		p.recvData()
+	}
+
+	// the first two segments are lost
+	dup := func() {
+		d := p.segment()
+		d.ACK = true
+		d.Acknowledgment = first.Sequence
+		d.Options = []*tcp.TCPOption{tcp.NewSACKOption([]tcp.SACKBlock{
+			{Left: first.Sequence + 2000, Right: first.Sequence + 4000},
+		})}
+		p.send(d)
+	}
+	for i := 0; i < 3; i++ {
+		dup()
+	}
+	if again := p.recvData(); again.Sequence != first.Sequence {
+		t.Fatal("expected the lost segment", again.Sequence, first.Sequence)
+	}
+
+	// pipe is 2000 bytes, as much as the halved window allows
+	dup()
+	select {
+	case pak := <-ep.Outbound():
+		t.Fatal("retransmission beyond the congestion window", len(pak))
+	case <-time.After(MinRTO / 2):
+	}
+}
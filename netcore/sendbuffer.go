@@ -0,0 +1,161 @@
+package netcore
+
+import (
+	"errors"
+	"time"
+)
+
+// DefaultSendBufferSize is the number of bytes a connection buffers before
+// Write blocks.
+const DefaultSendBufferSize = DefaultReceiveBufferSize
+
+// flush sends buffered data as far as the windows allow. Unless NoDelay is
+// set a segment smaller than the MSS waits while an earlier small segment is
+// unacknowledged (Nagle, RFC 896, with Minshall's refinement). A queued FIN
+// follows the last byte. The caller must
+// hold the state lock.
+func (c *Connection) flush() {
+	state := c.current
+	if c.closed {
+		return
+	}
+
+	sent := false
+	for len(c.sndBuf) > 0 {
+		usable := c.usableWindow()
+		if usable == 0 {
+			if state.sendWindow == 0 {
+				c.armPersist()
+			}
+			break
+		}
+
+		sz := len(c.sndBuf)
+		if sz > state.sendMSS {
+			sz = state.sendMSS
+		}
+		if sz > usable {
+			sz = usable
+		}
+		small := sz < state.sendMSS
+		if small && !c.noDelay && c.smallInFlight() {
+			break
+		}
+		c.sendSegment(&segment{seq: state.SendNext, data: c.sndBuf[:sz]})
+		state.SendNext = state.SendNext.add(uint32(sz))
+		if small {
+			c.smallSent = true
+			c.smallEnd = state.SendNext
+		}
+		c.sndBuf = c.sndBuf[sz:]
+		sent = true
+	}
+	if len(c.sndBuf) == 0 {
+		c.sndBuf = nil
+		if c.finQueued && !c.finSent {
+			c.sendSegment(&segment{seq: state.SendNext, fin: true})
+			state.SendNext = state.SendNext.add(1)
+			c.finSent = true
+		}
+	}
+	if sent {
+		c.notifyWritable()
+	}
+}
+
+// smallInFlight reports whether a segment smaller than the MSS is still
+// unacknowledged. The caller must hold the state lock.
+func (c *Connection) smallInFlight() bool {
+	return c.smallSent && c.current.SendUnAcknowledged.lessThan(c.smallEnd)
+}
+
+// finAcked reports whether our FIN was sent and acknowledged. The caller
+// must hold the state lock.
+func (c *Connection) finAcked() bool {
+	return c.finSent && c.current.SendUnAcknowledged == c.current.SendNext
+}
+
+// SetNoDelay controls whether small writes are sent at once (true) or
+// coalesced while data is unacknowledged (false, the default), see
+// net.TCPConn.
+func (c *Connection) SetNoDelay(noDelay bool) error {
+	state := c.current
+	state.lockObject.Lock()
+	defer state.lockObject.Unlock()
+	c.noDelay = noDelay
+	c.flush()
+	return nil
+}
+
+// SetReadBuffer sets the size of the receive buffer, which bounds the
+// advertised window. Beyond 64 KB it needs window scaling negotiated
+// during the handshake. The buffer never shrinks below the buffered data
+// and the window already advertised (RFC 1122 section 4.2.2.16).
+func (c *Connection) SetReadBuffer(bytes int) error {
+	if bytes <= 0 {
+		return errors.New("invalid buffer size")
+	}
+	if bytes > MaxReceiveBufferSize {
+		bytes = MaxReceiveBufferSize
+	}
+	state := c.current
+	state.lockObject.Lock()
+	defer state.lockObject.Unlock()
+	if least := len(c.buffer) + int(state.advertised); bytes < least {
+		bytes = least
+	}
+	c.setReceiveBuffer(bytes)
+	c.windowUpdate()
+	return nil
+}
+
+// SetWriteBuffer sets the number of bytes Write buffers before it blocks.
+func (c *Connection) SetWriteBuffer(bytes int) error {
+	if bytes <= 0 {
+		return errors.New("invalid buffer size")
+	}
+	state := c.current
+	state.lockObject.Lock()
+	defer state.lockObject.Unlock()
+	c.sndBufSize = bytes
+	c.notifyWritable()
+	return nil
+}
+
+// SetLinger sets the behavior of Close, see net.TCPConn. With sec < 0 (the
+// default) Close returns at once and the data is sent in the background,
+// with sec == 0 unsent data is discarded and the connection is reset, with
+// sec > 0 Close waits up to sec seconds for the data and our FIN to be
+// acknowledged and resets the connection after that.
+func (c *Connection) SetLinger(sec int) error {
+	state := c.current
+	state.lockObject.Lock()
+	defer state.lockObject.Unlock()
+	c.linger = sec
+	return nil
+}
+
+// lingerWait waits until our FIN is acknowledged, the connection is reset
+// when d passes first.
+func (c *Connection) lingerWait(d time.Duration) {
+	state := c.current
+	timeout := time.After(d)
+	for {
+		state.lockObject.Lock()
+		done := c.closed || c.finAcked()
+		state.lockObject.Unlock()
+		if done {
+			return
+		}
+
+		select {
+		case <-c.writable:
+		case <-c.done:
+		case <-timeout:
+			state.lockObject.Lock()
+			c.abort(errors.New("linger timeout"))
+			state.lockObject.Unlock()
+			return
+		}
+	}
+}
@@ -0,0 +1,232 @@
+package netcore
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Evan2698/netstackm/tcp"
+)
+
+func TestNagle(t *testing.T) {
+	s, ep := newTestStack(t)
+	defer ep.Close()
+
+	p := newPeer(t, ep, 1000)
+	p.handshake()
+	c, err := s.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.Write([]byte("a"))
+	if out := p.recvData(); string(out.Payload) != "a" {
+		t.Fatal("unexpected segment", out.Payload)
+	}
+	p.ack++
+
+	// held back while "a" is unacknowledged
+	c.Write([]byte("b"))
+	c.Write([]byte("c"))
+	select {
+	case b := <-ep.Outbound():
+		t.Fatal("small segment sent while data is in flight", len(b))
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	ack := p.segment()
+	ack.ACK = true
+	p.send(ack)
+	if out := p.recvData(); string(out.Payload) != "bc" {
+		t.Fatal("expected coalesced segment", string(out.Payload))
+	}
+}
+
+func TestNoDelay(t *testing.T) {
+	s, ep := newTestStack(t)
+	defer ep.Close()
+
+	p := newPeer(t, ep, 1000)
+	p.handshake()
+	c, err := s.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.SetNoDelay(true)
+
+	c.Write([]byte("a"))
+	c.Write([]byte("b"))
+	for _, want := range []string{"a", "b"} {
+		if out := p.recvData(); string(out.Payload) != want {
+			t.Fatal("unexpected segment", string(out.Payload), want)
+		}
+	}
+}
+
+func TestWriteBuffer(t *testing.T) {
+	s, ep := newTestStack(t)
+	defer ep.Close()
+
+	p := newPeer(t, ep, 1000)
+	p.wnd = 0
+	p.handshake()
+	c, err := s.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.SetWriteBuffer(4)
+
+	written := make(chan error, 1)
+	go func() {
+		_, err := c.Write([]byte("12345678"))
+		written <- err
+	}()
+	select {
+	case <-written:
+		t.Fatal("write must block on a full send buffer")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	p.wnd = 65535
+	open := p.segment()
+	open.ACK = true
+	p.send(open)
+	if err := <-written; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLingerZero(t *testing.T) {
+	s, ep := newTestStack(t)
+	defer ep.Close()
+
+	p := newPeer(t, ep, 1000)
+	p.wnd = 0
+	p.handshake()
+	c, err := s.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.Write([]byte("unsent"))
+	c.SetLinger(0)
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if out := p.recvData(); !out.RST {
+		t.Fatal("expected a reset", out.FIN, len(out.Payload))
+	}
+}
+
+func TestSetReadBuffer(t *testing.T) {
+	s, ep := newTestStack(t)
+	defer ep.Close()
+	s.SetReceiveBufferSize(4000)
+	s.SetDelayedACK(0)
+
+	p := newPeer(t, ep, 1000)
+	p.synOptions = []*tcp.TCPOption{tcp.NewMSSOption(1000)}
+	p.handshake()
+	c, err := s.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// growing the buffer announces the new window
+	c.SetReadBuffer(16000)
+	if a := p.recv(); a.WndSize != 16000 {
+		t.Fatal("expected a window update", a.WndSize)
+	}
+
+	send := func(wnd uint16) {
+		data := p.segment()
+		data.ACK = true
+		data.Payload = make([]byte, 1000)
+		p.send(data)
+		p.seq += 1000
+		if a := p.recv(); a.Acknowledgment != p.seq || a.WndSize != wnd {
+			t.Fatal("unexpected ack", a.Acknowledgment, p.seq, a.WndSize, wnd)
+		}
+	}
+	send(15000)
+	send(14000)
+
+	// shrinking must not take back the advertised window
+	c.SetReadBuffer(1000)
+	send(13000)
+}
+
+func TestLingerTimeout(t *testing.T) {
+	s, ep := newTestStack(t)
+	defer ep.Close()
+
+	p := newPeer(t, ep, 1000)
+	p.handshake()
+	c, err := s.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.Write([]byte("never acked"))
+	c.SetLinger(1)
+	start := time.Now()
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d < time.Second {
+		t.Fatal("close returned before the linger timeout", d)
+	}
+	for {
+		if out := p.recvData(); out.RST {
+			break
+		}
+	}
+}
+
+func TestLingerSuccess(t *testing.T) {
+	s, ep := newTestStack(t)
+	defer ep.Close()
+
+	p := newPeer(t, ep, 1000)
+	p.handshake()
+	c, err := s.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.Write([]byte("data"))
+	c.SetLinger(5)
+	closed := make(chan error, 1)
+	go func() {
+		closed <- c.Close()
+	}()
+
+	if out := p.recvData(); string(out.Payload) != "data" {
+		t.Fatal("unexpected segment", string(out.Payload))
+	}
+	if fin := p.recvData(); !fin.FIN {
+		t.Fatal("expected our FIN")
+	}
+	select {
+	case <-closed:
+		t.Fatal("close returned before the FIN was acknowledged")
+	default:
+	}
+
+	p.ack += uint32(len("data")) + 1
+	ack := p.segment()
+	ack.ACK = true
+	p.send(ack)
+	select {
+	case err := <-closed:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("close did not return after the FIN was acknowledged")
+	}
+	select {
+	case b := <-ep.Outbound():
+		t.Fatal("unexpected segment after a clean close", len(b))
+	case <-time.After(100 * time.Millisecond):
+	}
+}
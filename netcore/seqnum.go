@@ -0,0 +1,36 @@
+package netcore
+
+// seqnum is a TCP sequence number. Sequence numbers wrap around at 2^32, so
+// they are compared modulo 2^32 (RFC 793 section 3.3): v is less than w when
+// w lies less than 2^31 bytes ahead of v.
+type seqnum uint32
+
+// lessThan reports whether v comes before w.
+func (v seqnum) lessThan(w seqnum) bool {
+	return int32(v-w) < 0
+}
+
+// lessThanEq reports whether v comes before w or is w.
+func (v seqnum) lessThanEq(w seqnum) bool {
+	return v == w || v.lessThan(w)
+}
+
+// inRange reports whether first <= v < end.
+func (v seqnum) inRange(first, end seqnum) bool {
+	return v-first < end-first
+}
+
+// inWindow reports whether v lies in the size bytes starting at first.
+func (v seqnum) inWindow(first seqnum, size uint32) bool {
+	return v.inRange(first, first.add(size))
+}
+
+// add returns v advanced by n bytes.
+func (v seqnum) add(n uint32) seqnum {
+	return v + seqnum(n)
+}
+
+// size returns the number of bytes from v to w.
+func (v seqnum) size(w seqnum) uint32 {
+	return uint32(w - v)
+}
@@ -0,0 +1,123 @@
+package netcore
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestSeqnumCompare(t *testing.T) {
+	for _, tc := range []struct {
+		v, w seqnum
+		less bool
+	}{
+		{1, 2, true},
+		{2, 1, false},
+		{0xffffffff, 0, true},
+		{0, 0xffffffff, false},
+		{0xfffffff0, 0x10, true},
+		{0x10, 0x7fffffff, true},
+		{0x10, 0x90000000, false},
+	} {
+		if got := tc.v.lessThan(tc.w); got != tc.less {
+			t.Errorf("%#x < %#x = %v", tc.v, tc.w, got)
+		}
+		if got := tc.v.lessThanEq(tc.w); got != tc.less {
+			t.Errorf("%#x <= %#x = %v", tc.v, tc.w, got)
+		}
+	}
+	if v := seqnum(5); !v.lessThanEq(v) || v.lessThan(v) {
+		t.Error("a sequence number equals itself")
+	}
+}
+
+func TestSeqnumWindow(t *testing.T) {
+	first := seqnum(0xfffffff0)
+	for _, tc := range []struct {
+		v  seqnum
+		in bool
+	}{
+		{0xffffffef, false},
+		{0xfffffff0, true},
+		{0xffffffff, true},
+		{0, true},
+		{0xf, true},
+		{0x10, false},
+	} {
+		if got := tc.v.inWindow(first, 0x20); got != tc.in {
+			t.Errorf("%#x in window = %v", tc.v, got)
+		}
+	}
+	if first.inWindow(first, 0) {
+		t.Error("an empty window holds nothing")
+	}
+	if end := first.add(0x20); end != 0x10 || first.size(end) != 0x20 {
+		t.Error("unexpected end", end, first.size(end))
+	}
+}
+
+func TestSequenceWrap(t *testing.T) {
+	s, ep := newTestStack(t)
+	defer ep.Close()
+	s.SetDelayedACK(0)
+
+	// both directions cross 2^32 after a few bytes
+	p := newPeer(t, ep, 0xfffffff0)
+	syn := p.segment()
+	syn.SYN = true
+	s.passiveOpen(syn, 0xfffffff8)
+	p.seq++
+	synack := p.recvData()
+	if !synack.SYN || synack.Sequence != 0xfffffff8 {
+		t.Fatal("unexpected syn-ack", synack.Sequence)
+	}
+	p.ack = synack.Sequence + 1
+	ack := p.segment()
+	ack.ACK = true
+	p.send(ack)
+	c, err := s.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	in := bytes.Repeat([]byte("0123456789abcdef"), 2)
+	data := p.segment()
+	data.ACK = true
+	data.Payload = in
+	p.send(data)
+	p.seq += uint32(len(in))
+	if a := p.recv(); a.Acknowledgment != p.seq {
+		t.Fatal("unexpected ack", a.Acknowledgment, p.seq)
+	}
+	buf := make([]byte, 64)
+	n, err := c.Read(buf)
+	if err != nil || !bytes.Equal(buf[:n], in) {
+		t.Fatal("unexpected read", string(buf[:n]), err)
+	}
+
+	if _, err = c.Write(in); err != nil {
+		t.Fatal(err)
+	}
+	out := p.recvData()
+	if out.Sequence != p.ack || !bytes.Equal(out.Payload, in) {
+		t.Fatal("unexpected segment", out.Sequence, p.ack)
+	}
+	p.ack += uint32(len(out.Payload))
+	done := p.segment()
+	done.ACK = true
+	p.send(done)
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		c.current.lockObject.Lock()
+		una, unacked := c.current.SendUnAcknowledged, len(c.current.unacked)
+		c.current.lockObject.Unlock()
+		if una == seqnum(p.ack) && unacked == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("ack across the wrap not taken", una, p.ack)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,134 @@
+package netcore
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/Evan2698/chimney/utils"
+	"github.com/Evan2698/netstackm/common"
+)
+
+const (
+	// DefaultShutdownTimeout is the time Close waits for open connections.
+	DefaultShutdownTimeout = 2 * time.Second
+
+	shutdownPollInterval = 10 * time.Millisecond
+)
+
+// ShutdownResult reports how the connections of a stack were closed.
+type ShutdownResult struct {
+	// Closed is the number of TCP connections that finished the close
+	// handshake before the deadline.
+	Closed int
+	// ForceClosed holds the flow keys of the TCP connections that were reset
+	// because the deadline expired.
+	ForceClosed []string
+	// UDPClosed is the number of aborted UDP sessions.
+	UDPClosed int
+}
+
+// Shutdown stops the stack. New flows are refused, open TCP connections are
+// sent a FIN (or a RST while still in the handshake) and UDP sessions are
+// aborted. It then waits until the connections finish closing or ctx is
+// done; connections still open at that point are reset and reported in
+// ForceClosed, and ctx.Err() is returned. Finally the link endpoint is
+// closed and the ingress workers are drained.
+func (s *Stack) Shutdown(ctx context.Context) (*ShutdownResult, error) {
+	result := &ShutdownResult{}
+	first := false
+	s.quitOnce.Do(func() {
+		close(s.quit)
+		first = true
+	})
+	if !first {
+		return result, errors.New("stack already shut down")
+	}
+
+	tcps := s.t.Snapshot()
+	for _, state := range tcps {
+		if state.Conn != nil {
+			state.Conn.notifyclose()
+		}
+	}
+
+	for _, state := range s.u.Snapshot() {
+		if state.Connu != nil {
+			state.Connu.Close()
+			result.UDPClosed++
+		}
+	}
+
+	var err error
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	for s.pendingClose(tcps) > 0 && err == nil {
+		select {
+		case <-ctx.Done():
+			err = ctx.Err()
+		case <-ticker.C:
+		}
+	}
+
+	for _, state := range tcps {
+		c := state.Conn
+		if c == nil {
+			continue
+		}
+		state.lockObject.Lock()
+		if closeFinished(state.SocketState) {
+			result.Closed++
+			// no need to wait for 2*MSL
+			c.terminate(nil)
+		} else {
+			result.ForceClosed = append(result.ForceClosed,
+				common.GenerateUniqueKey(c.Src, c.Dst, c.SourcePort, c.DestinationPort))
+			c.abort(errors.New("stack shut down"))
+		}
+		state.lockObject.Unlock()
+	}
+
+	s.link.Close()
+	if s.d != nil {
+		select {
+		case <-s.exited:
+		case <-ctx.Done():
+			if err == nil {
+				err = ctx.Err()
+			}
+		}
+	}
+
+	s.t.ClearAll()
+	s.u.ClearAll()
+
+	utils.LOG.Println("stack shut down, closed:", result.Closed,
+		"force closed:", len(result.ForceClosed), "udp:", result.UDPClosed)
+	return result, err
+}
+
+func (s *Stack) stopping() bool {
+	select {
+	case <-s.quit:
+		return true
+	default:
+		return false
+	}
+}
+
+// pendingClose returns the number of connections which are still closing.
+func (s *Stack) pendingClose(states []*State) int {
+	n := 0
+	for _, state := range states {
+		state.lockObject.Lock()
+		if !closeFinished(state.SocketState) {
+			n++
+		}
+		state.lockObject.Unlock()
+	}
+	return n
+}
+
+func closeFinished(st SocketState) bool {
+	return st == SocketClosed || st == SocketTimeWait
+}
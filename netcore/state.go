@@ -23,17 +23,83 @@ type State struct {
 
 	Last time.Time
 
-	RecvNext           uint32
-	SendNext           uint32
-	SendUnAcknowledged uint32
-	LastAcked          uint32
+	RecvNext           seqnum
+	SendNext           seqnum
+	SendUnAcknowledged seqnum
+	LastAcked          seqnum
 
 	// flow control
-	recvWindow uint32
-	sendWindow uint32
+	recvWindow     uint32
+	advertised     uint32
+	rcvBufSize     int
+	sendWindow     uint32
+	sndWl1         seqnum
+	sndWl2         seqnum
+	persistTimer   *time.Timer
+	persistGen     int
+	persistBackoff time.Duration
 
 	SocketState SocketState
 
+	// negotiated segment sizes
+	sendMSS int
+	rcvMSS  int
+	// estimated size of the peer's full segments, see Linux rcv_mss
+	inMSS int
+
+	// window scaling
+	wsEnabled   bool
+	sndWndShift uint8
+	rcvWndShift uint8
+
+	// selective acknowledgment
+	sackEnabled bool
+	sacked      uint32
+	highSacked  seqnum
+
+	// timestamps
+	tsEnabled   bool
+	tsOffset    uint32
+	tsRecent    uint32
+	tsRecentAge time.Time
+	lastAckSent seqnum
+
+	// out-of-order segments
+	ooo *reassembler
+
+	// delayed ack
+	ackDelay   time.Duration
+	ackOnPush  bool
+	ackPending int
+	ackTimer   *time.Timer
+	ackGen     int
+
+	// keepalive
+	keepAlive       bool
+	keepAlivePeriod time.Duration
+	keepAliveTimer  *time.Timer
+	keepAliveGen    int
+	keepAliveProbes int
+
+	// time wait
+	timeWaitTimer *time.Timer
+	timeWaitGen   int
+
+	// retransmission
+	unacked  []*segment
+	rtoTimer *time.Timer
+	rtoGen   int
+	rto      time.Duration
+	srtt     time.Duration
+	rttvar   time.Duration
+	retries  int
+
+	// congestion control
+	cc         CongestionControl
+	dupAcks    int
+	inRecovery bool
+	recover    seqnum
+
 	Connu *UDPConnection
 
 	Conn *Connection
@@ -25,6 +25,19 @@ func (table *StateTable) Add(src, dst net.IP, sport, dport uint16, state *State)
 	return nil
 }
 
+// AddUnique adds state unless the flow is in the table already, it reports
+// whether state was added.
+func (table *StateTable) AddUnique(src, dst net.IP, sport, dport uint16, state *State) bool {
+	key := common.GenerateUniqueKey(src, dst, sport, dport)
+	table.lock.Lock()
+	defer table.lock.Unlock()
+	if _, ok := table.table[key]; ok {
+		return false
+	}
+	table.table[key] = state
+	return true
+}
+
 // Get ...
 func (table *StateTable) Get(src, dst net.IP, sport, dport uint16) *State {
 	key := common.GenerateUniqueKey(src, dst, sport, dport)
@@ -55,12 +68,37 @@ func (table *StateTable) Remove(src, dst net.IP, sport, dport uint16) *State {
 	return value
 }
 
-// ClearAll ...
-func (table *StateTable) ClearAll() {
+// RemoveState removes the flow only while it belongs to state.
+func (table *StateTable) RemoveState(src, dst net.IP, sport, dport uint16, state *State) {
+	key := common.GenerateUniqueKey(src, dst, sport, dport)
 	table.lock.Lock()
 	defer table.lock.Unlock()
+	if table.table[key] == state {
+		delete(table.table, key)
+	}
+}
+
+// Snapshot returns all states of the table.
+func (table *StateTable) Snapshot() []*State {
+	table.lock.RLock()
+	defer table.lock.RUnlock()
 
+	states := make([]*State, 0, len(table.table))
 	for _, v := range table.table {
+		states = append(states, v)
+	}
+	return states
+}
+
+// ClearAll ...
+func (table *StateTable) ClearAll() {
+	states := table.Snapshot()
+
+	table.lock.Lock()
+	table.table = make(map[string]*State)
+	table.lock.Unlock()
+
+	for _, v := range states {
 		if v.Conn != nil {
 			v.Conn.Close()
 		}
@@ -68,5 +106,4 @@ func (table *StateTable) ClearAll() {
 			v.Connu.Close()
 		}
 	}
-	table.table = nil
 }
@@ -0,0 +1,103 @@
+package netcore
+
+import (
+	"time"
+
+	"github.com/Evan2698/netstackm/tcp"
+)
+
+const (
+	// timestampsSize is the option space taken by NOP, NOP and the
+	// timestamps option on every segment.
+	timestampsSize = 12
+
+	// pawsIdle is the time after which TS.Recent is no longer trusted
+	// (RFC 7323 section 5.5).
+	pawsIdle = 24 * 24 * time.Hour
+)
+
+// tsEpoch is the origin of the timestamp clock.
+var tsEpoch = time.Now()
+
+// tsClock returns the timestamp clock of the connection in milliseconds.
+func tsClock(state *State) uint32 {
+	return uint32(time.Since(tsEpoch)/time.Millisecond) + state.tsOffset
+}
+
+// timestampsOption returns the timestamps option of an outgoing segment and
+// remembers the ack number it carries.
+func timestampsOption(state *State) []*tcp.TCPOption {
+	state.lastAckSent = state.RecvNext
+	return []*tcp.TCPOption{
+		tcp.NewNOPOption(),
+		tcp.NewNOPOption(),
+		tcp.NewTimestampsOption(tsClock(state), state.tsRecent),
+	}
+}
+
+// segmentOptions returns the options of a segment other than SYN, SACK
+// blocks are added to pure acks only.
+func segmentOptions(state *State, pure bool) []*tcp.TCPOption {
+	var opts []*tcp.TCPOption
+	if state.tsEnabled {
+		opts = timestampsOption(state)
+	}
+	if pure && state.sackEnabled && !state.ooo.empty() {
+		opts = append(opts, tcp.NewNOPOption(), tcp.NewNOPOption(), tcp.NewSACKOption(sackBlocks(state)))
+	}
+	return opts
+}
+
+// checkTimestamps applies PAWS to an inbound segment and updates TS.Recent.
+// It returns false when the segment is an old duplicate and has to be
+// dropped. The caller must hold the state lock.
+func (c *Connection) checkTimestamps(t *tcp.TCP) bool {
+	state := c.current
+	if !state.tsEnabled {
+		return true
+	}
+	val, _, ok := t.Timestamps()
+	if !ok {
+		// like Linux, accept segments which lost the option on the way
+		return true
+	}
+
+	if !t.RST && int32(val-state.tsRecent) < 0 && time.Since(state.tsRecentAge) < pawsIdle {
+		r := ack(state)
+		c.Stack.SendTo(packtcp(r))
+		return false
+	}
+
+	if int32(val-state.tsRecent) >= 0 && seqnum(t.Sequence).lessThanEq(state.lastAckSent) {
+		state.tsRecent = val
+		state.tsRecentAge = time.Now()
+	}
+	return true
+}
+
+// timestampsRTT returns the RTT measured by the echoed timestamp of t.
+func timestampsRTT(state *State, t *tcp.TCP) (time.Duration, bool) {
+	if !state.tsEnabled {
+		return 0, false
+	}
+	_, ecr, ok := t.Timestamps()
+	if !ok || ecr == 0 {
+		return 0, false
+	}
+	d := int32(tsClock(state) - ecr)
+	if d < 0 {
+		return 0, false
+	}
+	rtt := time.Duration(d) * time.Millisecond
+	if rtt < clockGranularity {
+		rtt = clockGranularity
+	}
+	return rtt, true
+}
+
+// random returns a random 32 bit number.
+func (s *Stack) random() uint32 {
+	s.m.Lock()
+	defer s.m.Unlock()
+	return s.r.Uint32()
+}
@@ -0,0 +1,97 @@
+package netcore
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Evan2698/netstackm/tcp"
+)
+
+func TestTimestamps(t *testing.T) {
+	s, ep := newTestStack(t)
+	defer ep.Close()
+
+	p := newPeer(t, ep, 1000)
+	p.synOptions = []*tcp.TCPOption{tcp.NewMSSOption(1000), tcp.NewTimestampsOption(100, 0)}
+	synack := p.handshake()
+	val, ecr, ok := synack.Timestamps()
+	if !ok || ecr != 100 {
+		t.Fatal("timestamps were not echoed", val, ecr, ok)
+	}
+	c, err := s.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the option takes 12 bytes of every segment
+	if _, err = c.Write(make([]byte, 2000)); err != nil {
+		t.Fatal(err)
+	}
+	out := p.recvData()
+	if len(out.Payload) != 1000-timestampsSize {
+		t.Fatal("unexpected segment size", len(out.Payload))
+	}
+	if _, ecr, ok = out.Timestamps(); !ok || ecr != 100 {
+		t.Fatal("unexpected echo", ecr, ok)
+	}
+	p.recvData()
+
+	// an old duplicate is dropped and acknowledged
+	old := p.segment()
+	old.ACK = true
+	old.Payload = []byte("old")
+	old.Options = []*tcp.TCPOption{tcp.NewTimestampsOption(99, val)}
+	p.send(old)
+
+	fresh := p.segment()
+	fresh.ACK = true
+	fresh.Payload = []byte("new")
+	fresh.Options = []*tcp.TCPOption{tcp.NewTimestampsOption(101, val)}
+	p.send(fresh)
+
+	buf := make([]byte, 16)
+	n, err := c.Read(buf)
+	if err != nil || string(buf[:n]) != "new" {
+		t.Fatal("unexpected read", string(buf[:n]), err)
+	}
+
+	c.current.lockObject.Lock()
+	recent := c.current.tsRecent
+	c.current.lockObject.Unlock()
+	if recent != 101 {
+		t.Fatal("unexpected TS.Recent", recent)
+	}
+}
+
+func TestTimestampsRTT(t *testing.T) {
+	state := &State{tsEnabled: true}
+	pak := tcp.Newtcp()
+	pak.Options = []*tcp.TCPOption{tcp.NewTimestampsOption(1, tsClock(state)-50)}
+
+	rtt, ok := timestampsRTT(state, pak)
+	if !ok || rtt < 50*time.Millisecond || rtt > time.Second {
+		t.Fatal("unexpected rtt", rtt, ok)
+	}
+}
+
+func TestTimestampsTinyMSS(t *testing.T) {
+	for _, mss := range []uint16{8, 12, 20} {
+		s, ep := newTestStack(t)
+
+		p := newPeer(t, ep, 1000)
+		p.synOptions = []*tcp.TCPOption{tcp.NewMSSOption(mss), tcp.NewTimestampsOption(100, 0)}
+		p.handshake()
+		c, err := s.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.SetNoDelay(true)
+		if _, err = c.Write(make([]byte, 200)); err != nil {
+			t.Fatal(err)
+		}
+		if out := p.recvData(); len(out.Payload) != MinMSS {
+			t.Fatal("unexpected segment size", mss, len(out.Payload))
+		}
+		ep.Close()
+	}
+}
@@ -0,0 +1,166 @@
+package netcore
+
+import (
+	"time"
+
+	"github.com/Evan2698/chimney/utils"
+	"github.com/Evan2698/netstackm/common"
+	"github.com/Evan2698/netstackm/tcp"
+)
+
+const (
+	// MSL is the maximum segment lifetime, Linux uses 30 seconds as well.
+	MSL = 30 * time.Second
+	// DefaultTimeWait is how long a closed connection stays in TIME_WAIT.
+	DefaultTimeWait = 2 * MSL
+	// DefaultTimeWaitLimit is the number of connections which may be in
+	// TIME_WAIT at the same time, beyond it connections close at once.
+	DefaultTimeWaitLimit = 4096
+)
+
+// SetTimeWait sets how long connections stay in TIME_WAIT after an active
+// close, zero closes them at once.
+func (s *Stack) SetTimeWait(d time.Duration) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if d < 0 {
+		d = 0
+	}
+	s.timeWait = d
+}
+
+// SetTimeWaitLimit caps the number of connections in TIME_WAIT.
+func (s *Stack) SetTimeWaitLimit(n int) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if n < 0 {
+		n = 0
+	}
+	s.timeWaitLimit = n
+}
+
+// TimeWaitCount returns the number of connections in TIME_WAIT.
+func (s *Stack) TimeWaitCount() int {
+	s.m.Lock()
+	defer s.m.Unlock()
+	return s.timeWaits
+}
+
+// holdTimeWait takes a TIME_WAIT slot and returns how long to keep it, it
+// fails when the limit is reached.
+func (s *Stack) holdTimeWait() (time.Duration, bool) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if s.timeWait == 0 || s.timeWaits >= s.timeWaitLimit {
+		return 0, false
+	}
+	s.timeWaits++
+	return s.timeWait, true
+}
+
+func (s *Stack) releaseTimeWait() {
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.timeWaits--
+}
+
+// enterTimeWait moves the connection to TIME_WAIT for 2*MSL (RFC 793), it is
+// closed at once when the TIME_WAIT table is full. The caller must hold the
+// state lock.
+func (c *Connection) enterTimeWait() {
+	state := c.current
+	c.stopRetransmit()
+	c.stopPersist()
+	c.stopKeepAlive()
+
+	d, ok := c.Stack.holdTimeWait()
+	if !ok {
+		utils.LOG.Println(common.GenerateUniqueKey(c.Src, c.Dst, c.SourcePort, c.DestinationPort),
+			"skip TIME_WAIT")
+		c.terminate(nil)
+		return
+	}
+	state.SocketState = SocketTimeWait
+	c.armTimeWait(d)
+}
+
+// armTimeWait (re)starts the TIME_WAIT timer. The caller must hold the state
+// lock.
+func (c *Connection) armTimeWait(d time.Duration) {
+	state := c.current
+	if state.timeWaitTimer != nil {
+		state.timeWaitTimer.Stop()
+	}
+	state.timeWaitGen++
+	gen := state.timeWaitGen
+	state.timeWaitTimer = time.AfterFunc(d, func() {
+		c.timeWaitTimeout(gen)
+	})
+}
+
+// stopTimeWait stops the TIME_WAIT timer. The caller must hold the state
+// lock.
+func (c *Connection) stopTimeWait() {
+	state := c.current
+	if state.timeWaitTimer != nil {
+		state.timeWaitTimer.Stop()
+		state.timeWaitTimer = nil
+	}
+	state.timeWaitGen++
+}
+
+func (c *Connection) timeWaitTimeout(gen int) {
+	state := c.current
+	state.lockObject.Lock()
+	defer state.lockObject.Unlock()
+
+	if gen != state.timeWaitGen {
+		return
+	}
+	state.timeWaitTimer = nil
+	c.terminate(nil)
+}
+
+// handleTimeWait acknowledges a retransmitted FIN, our last ack got lost, and
+// restarts the timer. The caller must hold the state lock.
+func (c *Connection) handleTimeWait(t *tcp.TCP) {
+	if !t.FIN {
+		return
+	}
+	r := ack(c.current)
+	c.Stack.SendTo(packtcp(r))
+	if d, ok := c.timeWaitDuration(); ok {
+		c.armTimeWait(d)
+	}
+}
+
+func (c *Connection) timeWaitDuration() (time.Duration, bool) {
+	c.Stack.m.Lock()
+	defer c.Stack.m.Unlock()
+	return c.Stack.timeWait, c.Stack.timeWait > 0
+}
+
+// handleTimeWaitSYN opens a new connection on the 4-tuple of a connection in
+// TIME_WAIT when the SYN cannot belong to the old one: its timestamp is
+// newer or, without timestamps, its sequence number lies above the old
+// receive sequence (RFC 6191). Other SYNs get an ack. The caller must hold
+// the state lock.
+func (c *Connection) handleTimeWaitSYN(t *tcp.TCP) {
+	state := c.current
+	reuse := state.RecvNext.lessThan(seqnum(t.Sequence))
+	if val, _, ok := t.Timestamps(); ok && state.tsEnabled {
+		reuse = int32(val-state.tsRecent) > 0
+	}
+	if !reuse || c.Stack.stopping() {
+		c.challengeACK()
+		return
+	}
+
+	utils.LOG.Println(common.GenerateUniqueKey(c.Src, c.Dst, c.SourcePort, c.DestinationPort),
+		"reuse TIME_WAIT connection")
+	// the new ISN lies above everything the old connection sent (RFC 1122
+	// section 4.2.2.13)
+	iss := state.SendNext.add(uint32(MAX_SEND_WINDOW) + 2)
+	c.terminate(nil)
+	c.Stack.passiveOpen(t, iss)
+}
@@ -0,0 +1,130 @@
+package netcore
+
+import (
+	"testing"
+	"time"
+)
+
+// activeClose closes a new connection from our side and answers with the
+// peer's FIN.
+func activeClose(t *testing.T, s *Stack, p *peer) *Connection {
+	p.handshake()
+	c, err := s.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	if fin := p.recvData(); !fin.FIN {
+		t.Fatal("expected our FIN")
+	}
+	p.ack++
+
+	fin := p.segment()
+	fin.ACK = true
+	fin.FIN = true
+	p.send(fin)
+	p.seq++
+	if a := p.recv(); a.Acknowledgment != p.seq {
+		t.Fatal("expected the ack of the FIN", a.Acknowledgment, p.seq)
+	}
+	return c
+}
+
+func TestTimeWaitExpires(t *testing.T) {
+	s, ep := newTestStack(t)
+	defer ep.Close()
+	s.SetTimeWait(100 * time.Millisecond)
+
+	p := newPeer(t, ep, 1000)
+	c := activeClose(t, s, p)
+	if n := s.TimeWaitCount(); n != 1 {
+		t.Fatal("unexpected TIME_WAIT count", n)
+	}
+
+	// a retransmitted FIN is acknowledged again
+	fin := p.segment()
+	fin.ACK = true
+	fin.FIN = true
+	fin.Sequence = p.seq - 1
+	p.send(fin)
+	if a := p.recv(); a.Acknowledgment != p.seq {
+		t.Fatal("expected the ack of the FIN", a.Acknowledgment, p.seq)
+	}
+
+	select {
+	case <-c.done:
+	case <-time.After(time.Second):
+		t.Fatal("TIME_WAIT did not expire")
+	}
+	if s.t.Get(p.src, p.dst, p.sport, p.dport) != nil {
+		t.Fatal("state left in the table")
+	}
+	if n := s.TimeWaitCount(); n != 0 {
+		t.Fatal("unexpected TIME_WAIT count", n)
+	}
+}
+
+func TestTimeWaitReuse(t *testing.T) {
+	s, ep := newTestStack(t)
+	defer ep.Close()
+
+	p := newPeer(t, ep, 1000)
+	old := activeClose(t, s, p)
+
+	// an old duplicate SYN gets an ack
+	dup := p.segment()
+	dup.SYN = true
+	dup.Sequence = 1000
+	p.send(dup)
+	if a := p.recv(); a.SYN || a.Acknowledgment != p.seq {
+		t.Fatal("expected an ack", a.SYN, a.Acknowledgment)
+	}
+
+	sendNext := p.ack
+	p.seq += 100000
+	synack := p.handshake()
+	if synack.Sequence != sendNext+uint32(MAX_SEND_WINDOW)+2 {
+		t.Fatal("unexpected ISN", synack.Sequence, sendNext)
+	}
+	c, err := s.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c == old {
+		t.Fatal("expected a new connection")
+	}
+	select {
+	case <-old.done:
+	default:
+		t.Fatal("old connection still open")
+	}
+	if n := s.TimeWaitCount(); n != 0 {
+		t.Fatal("unexpected TIME_WAIT count", n)
+	}
+
+	data := p.segment()
+	data.ACK = true
+	data.Payload = []byte("again")
+	p.send(data)
+	buf := make([]byte, 16)
+	if n, err := c.Read(buf); err != nil || string(buf[:n]) != "again" {
+		t.Fatal("unexpected read", string(buf[:n]), err)
+	}
+}
+
+func TestTimeWaitLimit(t *testing.T) {
+	s, ep := newTestStack(t)
+	defer ep.Close()
+	s.SetTimeWaitLimit(0)
+
+	p := newPeer(t, ep, 1000)
+	c := activeClose(t, s, p)
+	select {
+	case <-c.done:
+	case <-time.After(time.Second):
+		t.Fatal("connection must close at once")
+	}
+	if s.t.Get(p.src, p.dst, p.sport, p.dport) != nil {
+		t.Fatal("state left in the table")
+	}
+}
@@ -3,8 +3,8 @@ package netcore
 import (
 	"container/list"
 	"errors"
-	"io"
 	"net"
+	"sync"
 	"time"
 
 	"github.com/Evan2698/chimney/utils"
@@ -12,7 +12,11 @@ import (
 	"github.com/Evan2698/netstackm/udp"
 )
 
-// UDPConnection ...
+// UDPConnection is one UDP flow of the tun-side host, seen like a socket of
+// the destination the host addressed: LocalAddr is that destination and
+// RemoteAddr the tun-side host, which sends every datagram read. As a
+// net.PacketConn the host is the only peer, ReadFrom reports it and WriteTo
+// only accepts it.
 type UDPConnection struct {
 	Src, Dst                    net.IP
 	SourcePort, DestinationPort uint16
@@ -20,78 +24,90 @@ type UDPConnection struct {
 	cache                       *list.List
 	Recv                        chan []byte
 	current                     *State
-	closed                      bool
+	done                        chan struct{}
+	once                        sync.Once
+
+	// read and write deadlines
+	rd *deadline
+	wd *deadline
 }
 
-// LocalAddr returns the local network address.
+var (
+	_ net.Conn       = (*UDPConnection)(nil)
+	_ net.PacketConn = (*UDPConnection)(nil)
+)
+
+// LocalAddr returns the destination the tun-side host addressed.
 func (c *UDPConnection) LocalAddr() net.Addr {
-	return &net.TCPAddr{
-		IP:   c.Src,
-		Port: int(c.SourcePort),
+	return &net.UDPAddr{
+		IP:   c.Dst,
+		Port: int(c.DestinationPort),
 		Zone: "",
 	}
 }
 
-// RemoteAddr returns the remote network address.
+// RemoteAddr returns the address of the tun-side host.
 func (c *UDPConnection) RemoteAddr() net.Addr {
-	return &net.TCPAddr{
-		IP:   c.Dst,
-		Port: int(c.DestinationPort),
+	return &net.UDPAddr{
+		IP:   c.Src,
+		Port: int(c.SourcePort),
 		Zone: "",
 	}
 }
 
-// Read return n indicate byte numbers.
+// Read reads one datagram, the rest of a datagram longer than b is
+// discarded. It fails with a timeout error once the read deadline has
+// passed.
 func (c *UDPConnection) Read(b []byte) (n int, err error) {
-	if c.closed {
-		return 0, errors.New("UDP Closed")
-	}
-
-	n = -1
 	state := c.current
-	state.lockObject.Lock()
-	if c.cache.Len() > 0 {
-		v, ok := c.cache.Front().Value.([]byte)
-		if ok {
-			n = copy(b, v)
+	for {
+		if c.isClosed() {
+			return 0, c.closedError("read")
 		}
-		c.cache.Remove(c.cache.Front())
-	}
-	state.lockObject.Unlock()
-	if n > -1 {
-		return n, nil
-	}
-
-	select {
-	case <-time.After(300 * time.Second):
-		utils.LOG.Println("Timeout occured")
-		return 0, errors.New("Timeout occured")
-	case _, ok := <-c.Recv:
-		if !ok {
-			// connection closed?
-			if c.cache.Len() == 0 {
-				return 0, io.EOF
-			}
+		expired := c.rd.wait()
+		select {
+		case <-expired:
+			return 0, deadlineExceeded("read", "udp", c.LocalAddr(), c.RemoteAddr())
+		default:
 		}
+
 		state.lockObject.Lock()
 		if c.cache.Len() > 0 {
-			v, ok := c.cache.Front().Value.([]byte)
-			if ok {
-				n = copy(b, v)
-			}
-			c.cache.Remove(c.cache.Front())
+			v, _ := c.cache.Remove(c.cache.Front()).([]byte)
+			state.lockObject.Unlock()
+			return copy(b, v), nil
 		}
 		state.lockObject.Unlock()
-		return n, nil
+
+		select {
+		case <-expired:
+		case <-c.done:
+		case <-c.Recv:
+		}
+	}
+}
+
+// ReadFrom reads one datagram and returns the address of the tun-side host
+// which sent it.
+func (c *UDPConnection) ReadFrom(b []byte) (n int, addr net.Addr, err error) {
+	n, err = c.Read(b)
+	if err != nil {
+		return n, nil, err
 	}
+	return n, c.RemoteAddr(), nil
 }
 
 // Write writes data to the connection.
 // Write can be made to time out and return a Error with Timeout() == true
 // after a fixed time limit; see SetDeadline and SetWriteDeadline.
 func (c *UDPConnection) Write(b []byte) (n int, err error) {
-	if c.closed {
-		return 0, errors.New("UDP Closed")
+	if c.isClosed() {
+		return 0, c.closedError("write")
+	}
+	select {
+	case <-c.wd.wait():
+		return 0, deadlineExceeded("write", "udp", c.LocalAddr(), c.RemoteAddr())
+	default:
 	}
 
 	if len(b) > 0 {
@@ -110,10 +126,64 @@ func (c *UDPConnection) Write(b []byte) (n int, err error) {
 	return len(b), nil
 }
 
+// WriteTo writes one datagram to addr, which has to be the tun-side host.
+func (c *UDPConnection) WriteTo(b []byte, addr net.Addr) (n int, err error) {
+	ua, ok := addr.(*net.UDPAddr)
+	if !ok || !ua.IP.Equal(c.Src) || ua.Port != int(c.SourcePort) {
+		return 0, &net.OpError{
+			Op:     "write",
+			Net:    "udp",
+			Source: c.LocalAddr(),
+			Addr:   addr,
+			Err:    errors.New("address is not the peer of the flow"),
+		}
+	}
+	return c.Write(b)
+}
+
+func (c *UDPConnection) isClosed() bool {
+	select {
+	case <-c.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// closedError returns the error of op after a local Close.
+func (c *UDPConnection) closedError(op string) error {
+	return &net.OpError{
+		Op:     op,
+		Net:    "udp",
+		Source: c.LocalAddr(),
+		Addr:   c.RemoteAddr(),
+		Err:    net.ErrClosed,
+	}
+}
+
+// SetDeadline sets the read and write deadlines, see net.Conn.
+func (c *UDPConnection) SetDeadline(t time.Time) error {
+	c.rd.set(t)
+	c.wd.set(t)
+	return nil
+}
+
+// SetReadDeadline sets the deadline of Read calls, see net.Conn.
+func (c *UDPConnection) SetReadDeadline(t time.Time) error {
+	c.rd.set(t)
+	return nil
+}
+
+// SetWriteDeadline sets the deadline of Write calls, see net.Conn.
+func (c *UDPConnection) SetWriteDeadline(t time.Time) error {
+	c.wd.set(t)
+	return nil
+}
+
 func (c *UDPConnection) buildIPPacket(pkt *udp.UDP) []*ipv4.IPv4 {
 	var lu []*ipv4.IPv4
 
-	threshhold := ipv4.MTU - 28
+	threshhold := (c.Stack.MTU() - 28) &^ 7
 
 	rest := pkt.ToBytes()
 
@@ -167,6 +237,7 @@ func (c *UDPConnection) Open(t *udp.UDP) error {
 		DestPort: t.DstPort,
 		SrcIP:    t.SrcIP,
 		DestIP:   t.DstIP,
+		Last:     time.Now(),
 		Connu:    c,
 	}
 
@@ -178,7 +249,14 @@ func (c *UDPConnection) Open(t *udp.UDP) error {
 	state.lockObject.Lock()
 	c.current = state
 	state.lockObject.Unlock()
-	c.Stack.b <- c
+	select {
+	case c.Stack.b <- c:
+	default:
+		// never block the ingress worker on a slow AcceptUDP
+		utils.LOG.Println("udp accept queue is full, drop session")
+		c.handleClose()
+		return errors.New("udp accept queue is full")
+	}
 	c.dispatch(t)
 	return nil
 }
@@ -193,6 +271,7 @@ func (c *UDPConnection) run(t *udp.UDP) {
 	state := c.current
 	if pl > 0 {
 		state.lockObject.Lock()
+		state.Last = time.Now()
 		c.cache.PushBack(t.Payload)
 		state.lockObject.Unlock()
 		select {
@@ -208,16 +287,16 @@ func (c *UDPConnection) dispatch(t *udp.UDP) {
 }
 
 func (c *UDPConnection) handleClose() {
-	c.closed = true
+	c.once.Do(func() {
+		close(c.done)
+	})
 	c.Stack.u.Remove(c.Src, c.Dst, c.SourcePort, c.DestinationPort)
 }
 
 // Close ...
-func (c *UDPConnection) Close() {
+func (c *UDPConnection) Close() error {
 	c.handleClose()
-	u := udp.NewUDP()
-	u.Stop = true
-	close(c.Recv)
+	return nil
 }
 
 // NewUDPConnection ..
@@ -229,8 +308,11 @@ func NewUDPConnection(src, dst net.IP, sport, dport uint16, s *Stack) *UDPConnec
 		SourcePort:      sport,
 		DestinationPort: dport,
 		Stack:           s,
-		Recv:            make(chan []byte),
+		Recv:            make(chan []byte, 1),
 		cache:           list.New(),
+		done:            make(chan struct{}),
+		rd:              newDeadline(),
+		wd:              newDeadline(),
 	}
 	return v
 }
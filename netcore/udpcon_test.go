@@ -0,0 +1,114 @@
+package netcore
+
+import (
+	"errors"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/Evan2698/netstackm/ipv4"
+	"github.com/Evan2698/netstackm/udp"
+)
+
+// udpPacket builds a datagram from 10.0.0.2:5353 to 1.1.1.1:53.
+func udpPacket(payload []byte) []byte {
+	u := udp.NewUDP()
+	u.SrcIP = net.IPv4(10, 0, 0, 2).To4()
+	u.DstIP = net.IPv4(1, 1, 1, 1).To4()
+	u.SrcPort, u.DstPort = 5353, 53
+	u.Payload = payload
+	ip := ipv4.NewIPv4()
+	ip.Version = 4
+	ip.Protocol = ipv4.IPProtocolUDP
+	ip.Identification = ipv4.GeneratorIPID()
+	ip.SrcIP, ip.DstIP = u.SrcIP, u.DstIP
+	ip.TTL = 64
+	ip.Flags = 0x2
+	ip.PayLoad = u.ToBytes()
+	return ip.ToBytes()
+}
+
+func TestUDPPacketConn(t *testing.T) {
+	s, ep := newTestStack(t)
+	defer ep.Close()
+
+	src := net.IPv4(10, 0, 0, 2).To4()
+	dst := net.IPv4(1, 1, 1, 1).To4()
+	if err := ep.Inject(udpPacket([]byte("query"))); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := s.AcceptUDP()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if la, ok := c.LocalAddr().(*net.UDPAddr); !ok || !la.IP.Equal(dst) || la.Port != 53 {
+		t.Fatal("unexpected local address", c.LocalAddr())
+	}
+	if ra, ok := c.RemoteAddr().(*net.UDPAddr); !ok || !ra.IP.Equal(src) || ra.Port != 5353 {
+		t.Fatal("unexpected remote address", c.RemoteAddr())
+	}
+
+	buf := make([]byte, 64)
+	n, addr, err := c.ReadFrom(buf)
+	if err != nil || string(buf[:n]) != "query" {
+		t.Fatal("unexpected read", string(buf[:n]), err)
+	}
+	if addr.String() != c.RemoteAddr().String() {
+		t.Fatal("the sender is the tun-side host", addr)
+	}
+	if _, err = c.WriteTo([]byte("answer"), addr); err != nil {
+		t.Fatal(err)
+	}
+	<-ep.Outbound()
+	if _, err = c.WriteTo([]byte("answer"), &net.UDPAddr{IP: dst, Port: 53}); err == nil {
+		t.Fatal("write to a foreign address must fail")
+	}
+
+	c.SetReadDeadline(time.Now().Add(20 * time.Millisecond))
+	if _, err = c.Read(buf); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatal("expected a timeout", err)
+	}
+
+	c.Close()
+	if _, err = c.Read(buf); !errors.Is(err, net.ErrClosed) {
+		t.Fatal("expected a closed error", err)
+	}
+}
+
+func TestUDPCloseBlockedRead(t *testing.T) {
+	s, ep := newTestStack(t)
+	defer ep.Close()
+
+	if err := ep.Inject(udpPacket([]byte("query"))); err != nil {
+		t.Fatal(err)
+	}
+	c, err := s.AcceptUDP()
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 64)
+	if _, err = c.Read(buf); err != nil {
+		t.Fatal(err)
+	}
+
+	read := make(chan error, 1)
+	go func() {
+		_, err := c.Read(buf)
+		read <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+	c.Close()
+
+	var opErr *net.OpError
+	if err = <-read; !errors.As(err, &opErr) || !errors.Is(err, net.ErrClosed) {
+		t.Fatal("expected a closed error from the blocked read", err)
+	}
+	if _, err = c.Read(buf); !errors.As(err, &opErr) || !errors.Is(err, net.ErrClosed) {
+		t.Fatal("expected a closed error", err)
+	}
+	if _, err = c.Write([]byte("late")); !errors.Is(err, net.ErrClosed) {
+		t.Fatal("expected a closed error", err)
+	}
+}
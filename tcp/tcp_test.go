@@ -72,3 +72,57 @@ func Test_TCP2(t *testing.T) {
 		tcphdr.Payload = []byte{0x23, 0x23}*/
 
 }
+
+func Test_TCPOptions(t *testing.T) {
+	// SYN with MSS 1460, SACK permitted, timestamps, NOP and window scale 7
+	var syn = []byte{69, 0, 0, 60, 63, 93, 64, 0, 64, 6, 205, 60, 11, 11, 12, 12, 11, 11, 12, 1, 207, 202, 0, 80, 255, 186, 111, 12, 0, 0, 0, 0, 160, 2, 114, 16, 86, 170, 0, 0, 2, 4, 5, 180, 4, 2, 8, 10, 26, 116, 247, 204, 0, 0, 0, 0, 1, 3, 3, 7}
+
+	ip := ipv4.NewIPv4()
+	if err := ip.TryParseBasicHeader(syn[:20]); err != nil {
+		t.Fatal(err)
+	}
+	if err := ip.TryParseBody(syn[20:]); err != nil {
+		t.Fatal(err)
+	}
+	pkt, err := ParseTCP(ip)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mss, ok := pkt.MSS()
+	if !ok || mss != 1460 {
+		t.Fatal("unexpected mss", mss, ok)
+	}
+
+	shift, ok := pkt.WindowScale()
+	if !ok || shift != 7 {
+		t.Fatal("unexpected window scale", shift, ok)
+	}
+
+	if !pkt.SACKPermitted() {
+		t.Fatal("sack permitted option not found")
+	}
+
+	val, ecr, ok := pkt.Timestamps()
+	if !ok || val != 0x1a74f7cc || ecr != 0 {
+		t.Fatal("unexpected timestamps", val, ecr, ok)
+	}
+}
+
+func Test_SACKOption(t *testing.T) {
+	tpk := Newtcp()
+	tpk.SrcIP = net.ParseIP("11.11.11.11")
+	tpk.DstIP = net.ParseIP("11.11.22.22")
+	tpk.ACK = true
+	blocks := []SACKBlock{{Left: 100, Right: 200}, {Left: 0xfffffff0, Right: 10}}
+	tpk.Options = []*TCPOption{NewNOPOption(), NewNOPOption(), NewSACKOption(blocks)}
+
+	out := Newtcp()
+	if err := out.TryParse(tpk.ToBytes()); err != nil {
+		t.Fatal(err)
+	}
+	got := out.SACKBlocks()
+	if len(got) != 2 || got[0] != blocks[0] || got[1] != blocks[1] {
+		t.Fatal("unexpected sack blocks", got)
+	}
+}
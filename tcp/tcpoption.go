@@ -2,11 +2,23 @@ package tcp
 
 import (
 	"bytes"
+	"encoding/binary"
 	"errors"
 
 	"github.com/Evan2698/chimney/utils"
 )
 
+// option kinds
+const (
+	OptionEnd           uint8 = 0
+	OptionNOP           uint8 = 1
+	OptionMSS           uint8 = 2
+	OptionWindowScale   uint8 = 3
+	OptionSACKPermitted uint8 = 4
+	OptionSACK          uint8 = 5
+	OptionTimestamps    uint8 = 8
+)
+
 // TCPOption ...
 type TCPOption struct {
 	Type   uint8
@@ -35,6 +47,9 @@ func (o *TCPOption) FromBytes(op []byte) error {
 		o.Data = nil
 		o.End = (op[0] == 0)
 	} else {
+		if len(op) < 2 || op[1] < 2 || int(op[1]) > len(op) {
+			return errors.New("invalid option length")
+		}
 		o.Length = op[1]
 		o.Data = op[2:o.Length]
 		if len(o.Data) == 0 {
@@ -62,6 +77,42 @@ func NewTCPOption() *TCPOption {
 	return &TCPOption{}
 }
 
+// NewNOPOption ...
+func NewNOPOption() *TCPOption {
+	return &TCPOption{
+		Type:   OptionNOP,
+		Length: 1,
+	}
+}
+
+// NewMSSOption ...
+func NewMSSOption(mss uint16) *TCPOption {
+	return &TCPOption{
+		Type:   OptionMSS,
+		Length: 4,
+		Data:   []byte{byte(mss >> 8), byte(mss)},
+	}
+}
+
+// FindOption returns the first option of kind, nil when t does not carry it.
+func (t *TCP) FindOption(kind uint8) *TCPOption {
+	for _, o := range t.Options {
+		if o.Type == kind {
+			return o
+		}
+	}
+	return nil
+}
+
+// MSS returns the value of the MSS option.
+func (t *TCP) MSS() (uint16, bool) {
+	o := t.FindOption(OptionMSS)
+	if o == nil || len(o.Data) != 2 {
+		return 0, false
+	}
+	return binary.BigEndian.Uint16(o.Data), true
+}
+
 // Dump ...
 func (o *TCPOption) Dump() {
 	utils.LOG.Println("==========================")
@@ -71,3 +122,92 @@ func (o *TCPOption) Dump() {
 	utils.LOG.Println("==========================")
 
 }
+
+// NewWindowScaleOption ...
+func NewWindowScaleOption(shift uint8) *TCPOption {
+	return &TCPOption{
+		Type:   OptionWindowScale,
+		Length: 3,
+		Data:   []byte{shift},
+	}
+}
+
+// WindowScale returns the shift count of the window scale option.
+func (t *TCP) WindowScale() (uint8, bool) {
+	o := t.FindOption(OptionWindowScale)
+	if o == nil || len(o.Data) != 1 {
+		return 0, false
+	}
+	return o.Data[0], true
+}
+
+// NewSACKPermittedOption ...
+func NewSACKPermittedOption() *TCPOption {
+	return &TCPOption{
+		Type:   OptionSACKPermitted,
+		Length: 2,
+	}
+}
+
+// SACKPermitted reports whether t carries the SACK-permitted option.
+func (t *TCP) SACKPermitted() bool {
+	return t.FindOption(OptionSACKPermitted) != nil
+}
+
+// SACKBlock is one block of a SACK option, Left is the first sequence
+// number of the block and Right the sequence number following it.
+type SACKBlock struct {
+	Left  uint32
+	Right uint32
+}
+
+// NewSACKOption ...
+func NewSACKOption(blocks []SACKBlock) *TCPOption {
+	data := make([]byte, 8*len(blocks))
+	for i, b := range blocks {
+		binary.BigEndian.PutUint32(data[8*i:], b.Left)
+		binary.BigEndian.PutUint32(data[8*i+4:], b.Right)
+	}
+	return &TCPOption{
+		Type:   OptionSACK,
+		Length: uint8(2 + len(data)),
+		Data:   data,
+	}
+}
+
+// SACKBlocks returns the blocks of the SACK option.
+func (t *TCP) SACKBlocks() []SACKBlock {
+	o := t.FindOption(OptionSACK)
+	if o == nil {
+		return nil
+	}
+	blocks := make([]SACKBlock, 0, len(o.Data)/8)
+	for i := 0; i+8 <= len(o.Data); i += 8 {
+		blocks = append(blocks, SACKBlock{
+			Left:  binary.BigEndian.Uint32(o.Data[i:]),
+			Right: binary.BigEndian.Uint32(o.Data[i+4:]),
+		})
+	}
+	return blocks
+}
+
+// NewTimestampsOption ...
+func NewTimestampsOption(val, ecr uint32) *TCPOption {
+	data := make([]byte, 8)
+	binary.BigEndian.PutUint32(data, val)
+	binary.BigEndian.PutUint32(data[4:], ecr)
+	return &TCPOption{
+		Type:   OptionTimestamps,
+		Length: 10,
+		Data:   data,
+	}
+}
+
+// Timestamps returns TSval and TSecr of the timestamps option.
+func (t *TCP) Timestamps() (val uint32, ecr uint32, ok bool) {
+	o := t.FindOption(OptionTimestamps)
+	if o == nil || len(o.Data) != 8 {
+		return 0, 0, false
+	}
+	return binary.BigEndian.Uint32(o.Data), binary.BigEndian.Uint32(o.Data[4:]), true
+}